@@ -12,8 +12,14 @@ import (
 	"crypto"
 	"crypto/rsa"
 	"errors"
+	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 
 	"github.com/nogoegst/onionutil/pkcs1"
 	"golang.org/x/crypto/ed25519"
@@ -49,6 +55,71 @@ func OnionAddress(pk crypto.PublicKey) (string, error) {
 	}
 }
 
+// StripOnionTLD lowercases host name s, trims surrounding whitespace and
+// the trailing dot of a fully qualified name, and strips ".onion" TLD
+// (in any case). ok reports whether s had the TLD.
+func StripOnionTLD(s string) (stripped string, ok bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, ".")
+	stripped = strings.TrimSuffix(s, ".onion")
+	return stripped, stripped != s
+}
+
+// NormalizeOnionAddress converts onion address addr into the canonical
+// form: lowercase and without ".onion" suffix (see StripOnionTLD).
+func NormalizeOnionAddress(addr string) string {
+	addr, _ = StripOnionTLD(addr)
+	return addr
+}
+
+// defaultPorts are ports implied by URL schemes without explicit port.
+var defaultPorts = map[string]uint16{
+	"http":  80,
+	"https": 443,
+	"ws":    80,
+	"wss":   443,
+}
+
+// ParseOnionTarget extracts onion address and port from a URL (like
+// "http://expyuzz4wqqyqhjn.onion:8080/path") or a SOCKS target (like
+// "expyuzz4wqqyqhjn.onion:80"). URLs without explicit port get the
+// default port of their scheme. Subdomains of onion addresses are
+// accepted. The address is returned normalized (see NormalizeOnionAddress).
+func ParseOnionTarget(s string) (address string, port uint16, err error) {
+	hostport := s
+	var scheme string
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", 0, err
+		}
+		scheme, hostport = strings.ToLower(u.Scheme), u.Host
+	}
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		p, ok := defaultPorts[scheme]
+		if !ok {
+			return "", 0, fmt.Errorf("no port in %q", s)
+		}
+		host, port = hostport, p
+	} else {
+		port, err = InetPortFromByteString([]byte(portStr))
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid port %q: %v", portStr, err)
+		}
+	}
+	stripped, ok := StripOnionTLD(host)
+	if !ok {
+		return "", 0, fmt.Errorf("%q is not an onion host", host)
+	}
+	labels := strings.Split(stripped, ".")
+	address = labels[len(labels)-1]
+	if !OnionAddressIsValid(address) {
+		return "", 0, fmt.Errorf("invalid onion address %q", address)
+	}
+	return address, port, nil
+}
+
 // Check whether onion address is a valid one.
 func OnionAddressIsValid(onionAddress string) bool {
 	v2v := OnionAddressIsValidV2(onionAddress)
@@ -99,10 +170,22 @@ func RSAPubkeyHash(pk *rsa.PublicKey) (derHash []byte, err error) {
 	if err != nil {
 		return
 	}
-	derHash = Hash(der)
+	derHash = keyDigest(der)
 	return derHash, err
 }
 
+// RelayIdentityDigest returns identity digest of a relay with RSA
+// identity key identityKey: SHA1 of its DER encoding, the value relay
+// fingerprints are hex of and IntroductionPoint.Identity holds. It
+// returns nil if the key can't be encoded.
+func RelayIdentityDigest(identityKey *rsa.PublicKey) []byte {
+	digest, err := RSAPubkeyHash(identityKey)
+	if err != nil {
+		return nil
+	}
+	return digest
+}
+
 // Calculate permanent ID from RSA public key
 func CalcPermanentID(pk *rsa.PublicKey) (permId []byte, err error) {
 	derHash, err := RSAPubkeyHash(pk)
@@ -164,6 +247,82 @@ func OnionAddressPublicKeyV3(onionAddress string) (ed25519.PublicKey, error) {
 	return ed25519.PublicKey(pk), nil
 }
 
+// ValidateOnionAddressesV3 validates v3 onion addresses addrs in parallel.
+// The result holds error for every address in addrs, nil for valid ones.
+func ValidateOnionAddressesV3(addrs []string) []error {
+	errs := make([]error, len(addrs))
+	workers := runtime.NumCPU()
+	if workers > len(addrs) {
+		workers = len(addrs)
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				_, errs[i] = OnionAddressPublicKeyV3(NormalizeOnionAddress(addrs[i]))
+			}
+		}()
+	}
+	for i := range addrs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return errs
+}
+
+// KeyError is returned by AddressesForKeys for a key it fails on.
+type KeyError struct {
+	// Index is the position of the key in the input.
+	Index int
+	Err   error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("key %d: %v", e.Index, e.Err)
+}
+
+// AddressesForKeys computes v2 onion addresses of keys in parallel.
+// Addresses are returned in the order of keys. If some keys are invalid,
+// it returns *KeyError for the first of them.
+func AddressesForKeys(keys []*rsa.PublicKey) ([]string, error) {
+	addrs := make([]string, len(keys))
+	errs := make([]error, len(keys))
+	workers := runtime.NumCPU()
+	if workers > len(keys) {
+		workers = len(keys)
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if keys[i] == nil {
+					errs[i] = errors.New("nil key")
+					continue
+				}
+				addrs[i], errs[i] = OnionAddressV2(keys[i])
+			}
+		}()
+	}
+	for i := range keys {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, &KeyError{Index: i, Err: err}
+		}
+	}
+	return addrs, nil
+}
+
 // Generate v3 onion address key (Ed25519) using rand as the entropy source
 func GenerateOnionKeyV3(rand io.Reader) (crypto.PrivateKey, error) {
 	_, sk, err := ed25519.GenerateKey(rand)
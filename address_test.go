@@ -0,0 +1,161 @@
+package onionutil
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestValidateOnionAddressesV3(t *testing.T) {
+	valid := "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd"
+	addrs := []string{
+		valid,
+		valid + ".onion",
+		"pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscrye", // bad checksum
+		"expyuzz4wqqyqhjn", // v2
+		"not an address",
+	}
+	for i := 0; i < 100; i++ {
+		addrs = append(addrs, valid)
+	}
+	errs := ValidateOnionAddressesV3(addrs)
+	if len(errs) != len(addrs) {
+		t.Fatalf("expected %d results, got %d", len(addrs), len(errs))
+	}
+	for i, err := range errs {
+		invalid := i >= 2 && i <= 4
+		if invalid && err == nil {
+			t.Errorf("%s: no error for invalid address", addrs[i])
+		}
+		if !invalid && err != nil {
+			t.Errorf("%s: %v", addrs[i], err)
+		}
+	}
+	if errs := ValidateOnionAddressesV3(nil); len(errs) != 0 {
+		t.Errorf("unexpected results for empty list")
+	}
+}
+
+func TestStripOnionTLD(t *testing.T) {
+	for _, s := range []string{
+		"expyuzz4wqqyqhjn.onion",
+		"expyuzz4wqqyqhjn.Onion",
+		"expyuzz4wqqyqhjn.ONION",
+		"expyuzz4wqqyqhjn.onion.",
+		" ExpYuzz4wqqyqhjn.Onion.\n",
+	} {
+		stripped, ok := StripOnionTLD(s)
+		if !ok || stripped != "expyuzz4wqqyqhjn" {
+			t.Errorf("%q: got %q, %v", s, stripped, ok)
+		}
+		if _, err := ParseOnionAddressV2(s); err != nil {
+			t.Errorf("%q: %v", s, err)
+		}
+	}
+	for _, s := range []string{"expyuzz4wqqyqhjn", "expyuzz4wqqyqhjn.", "onion.example", "expyuzz4wqqyqhjn.onion.."} {
+		if stripped, ok := StripOnionTLD(s); ok {
+			t.Errorf("%q: TLD is stripped: %q", s, stripped)
+		}
+	}
+}
+
+func TestParseOnionTarget(t *testing.T) {
+	v3 := "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd"
+	for _, tc := range []struct {
+		target  string
+		address string
+		port    uint16
+	}{
+		{"http://expyuzz4wqqyqhjn.onion:8080/path", "expyuzz4wqqyqhjn", 8080},
+		{"http://expyuzz4wqqyqhjn.onion/path", "expyuzz4wqqyqhjn", 80},
+		{"HTTPS://www.ExpYuzz4wqqyqhjn.onion", "expyuzz4wqqyqhjn", 443},
+		{"expyuzz4wqqyqhjn.onion:80", "expyuzz4wqqyqhjn", 80},
+		{"expyuzz4wqqyqhjn.ONION.:80", "expyuzz4wqqyqhjn", 80},
+		{v3 + ".onion:22", v3, 22},
+		{"ssh://" + v3 + ".onion:2222", v3, 2222},
+	} {
+		address, port, err := ParseOnionTarget(tc.target)
+		if err != nil {
+			t.Errorf("%s: %v", tc.target, err)
+			continue
+		}
+		if address != tc.address || port != tc.port {
+			t.Errorf("%s: got %s:%d", tc.target, address, port)
+		}
+	}
+	for _, target := range []string{
+		"http://example.com/",
+		"example.com:80",
+		"expyuzz4wqqyqhjn.onion",
+		"ssh://expyuzz4wqqyqhjn.onion",
+		"expyuzz4wqqyqhjn.onion:99999",
+		"expyuzz4wqqyqhj1.onion:80",
+		"http://[::1]:80/",
+	} {
+		if _, _, err := ParseOnionTarget(target); err == nil {
+			t.Errorf("%s: no error", target)
+		}
+	}
+}
+
+func TestRelayIdentityDigest(t *testing.T) {
+	data, err := ioutil.ReadFile("test/descriptors/hartwellnogoegst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs, _ := ParseOnionDescriptors(data)
+	if len(descs) != 1 {
+		t.Fatal("unable to parse descriptor")
+	}
+	digest := RelayIdentityDigest(descs[0].PermanentKey)
+	if fingerprint := fmt.Sprintf("%X", digest); fingerprint != "38233B116B6B8CE21A53327212DDCA249C1AC8FB" {
+		t.Errorf("unexpected fingerprint %s", fingerprint)
+	}
+	if Base32Encode(digest[:OnionAddressLengthV2]) != "hartwellnogoegst" {
+		t.Error("digest doesn't match the onion address")
+	}
+	if RelayIdentityDigest(&rsa.PublicKey{}) != nil {
+		t.Error("digest of invalid key")
+	}
+}
+
+func TestAddressesForKeys(t *testing.T) {
+	sk, err := GenerateOnionKeyV2(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []*rsa.PublicKey{
+		&testPrivateKey(t).PublicKey,
+		&sk.(*rsa.PrivateKey).PublicKey,
+		&testPrivateKey(t).PublicKey,
+	}
+	addrs, err := AddressesForKeys(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != len(keys) {
+		t.Fatalf("got %d addresses for %d keys", len(addrs), len(keys))
+	}
+	for i, key := range keys {
+		expected, err := OnionAddressV2(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addrs[i] != expected {
+			t.Errorf("address %d: expected %s, got %s", i, expected, addrs[i])
+		}
+	}
+
+	addrs, err = AddressesForKeys(append(keys, nil, nil))
+	if keyErr, ok := err.(*KeyError); !ok || keyErr.Index != len(keys) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if addrs != nil {
+		t.Errorf("addresses are returned along with error")
+	}
+	if addrs, err := AddressesForKeys(nil); err != nil || len(addrs) != 0 {
+		t.Errorf("unexpected result for no keys: %v, %v", addrs, err)
+	}
+}
@@ -0,0 +1,135 @@
+// addresstypes.go - validated onion address types.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// AddressV2 is a v2 onion address, i.e. permanent id of the service.
+// It can be obtained via ParseOnionAddressV2 or AddressV2FromKey.
+type AddressV2 [10]byte
+
+// ParseOnionAddressV2 parses v2 onion address s. The ".onion" suffix
+// and uppercase letters are accepted.
+func ParseOnionAddressV2(s string) (AddressV2, error) {
+	var addr AddressV2
+	s = NormalizeOnionAddress(s)
+	permID, err := Base32Decode(s)
+	if err != nil || len(permID) != len(addr) {
+		return addr, fmt.Errorf("invalid v2 onion address %q", s)
+	}
+	copy(addr[:], permID)
+	return addr, nil
+}
+
+// AddressV2FromKey returns v2 onion address of permanent key pk.
+func AddressV2FromKey(pk *rsa.PublicKey) (AddressV2, error) {
+	var addr AddressV2
+	permID, err := CalcPermanentID(pk)
+	if err != nil {
+		return addr, err
+	}
+	copy(addr[:], permID)
+	return addr, nil
+}
+
+// String returns the address without ".onion" suffix.
+func (addr AddressV2) String() string {
+	return Base32Encode(addr[:])
+}
+
+// PermanentID returns permanent id of the service.
+func (addr AddressV2) PermanentID() []byte {
+	return append([]byte{}, addr[:]...)
+}
+
+// MatchesKey reports whether pk is the permanent key of the service.
+func (addr AddressV2) MatchesKey(pk *rsa.PublicKey) bool {
+	permID, err := CalcPermanentID(pk)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(permID, addr[:])
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (addr AddressV2) MarshalText() ([]byte, error) {
+	return []byte(addr.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (addr *AddressV2) UnmarshalText(text []byte) error {
+	parsed, err := ParseOnionAddressV2(string(text))
+	if err != nil {
+		return err
+	}
+	*addr = parsed
+	return nil
+}
+
+// AddressV3 is a v3 onion address with verified checksum and version.
+// It can be obtained via ParseOnionAddressV3 or AddressV3FromKey.
+type AddressV3 [ed25519.PublicKeySize]byte
+
+// ParseOnionAddressV3 parses and verifies v3 onion address s. The
+// ".onion" suffix and uppercase letters are accepted.
+func ParseOnionAddressV3(s string) (AddressV3, error) {
+	var addr AddressV3
+	pk, err := OnionAddressPublicKeyV3(NormalizeOnionAddress(s))
+	if err != nil {
+		return addr, err
+	}
+	copy(addr[:], pk)
+	return addr, nil
+}
+
+// AddressV3FromKey returns v3 onion address of public key pk.
+func AddressV3FromKey(pk ed25519.PublicKey) AddressV3 {
+	var addr AddressV3
+	copy(addr[:], pk)
+	return addr
+}
+
+// String returns the address without ".onion" suffix.
+func (addr AddressV3) String() string {
+	onionAddress, _ := OnionAddressV3(addr.PublicKey())
+	return onionAddress
+}
+
+// PublicKey returns Ed25519 public key of the service.
+func (addr AddressV3) PublicKey() ed25519.PublicKey {
+	return ed25519.PublicKey(append([]byte{}, addr[:]...))
+}
+
+// Bytes returns binary form of the address: public key, checksum and
+// version.
+func (addr AddressV3) Bytes() []byte {
+	b := append([]byte{}, addr[:]...)
+	b = append(b, OnionAddressChecksumV3(addr[:])...)
+	return append(b, OnionAddressVersionFieldV3...)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (addr AddressV3) MarshalText() ([]byte, error) {
+	return []byte(addr.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (addr *AddressV3) UnmarshalText(text []byte) error {
+	parsed, err := ParseOnionAddressV3(string(text))
+	if err != nil {
+		return err
+	}
+	*addr = parsed
+	return nil
+}
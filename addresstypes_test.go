@@ -0,0 +1,121 @@
+package onionutil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestAddressV3(t *testing.T) {
+	pk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onionAddress, err := OnionAddressV3(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := ParseOnionAddressV3(onionAddress + ".onion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != AddressV3FromKey(pk) {
+		t.Error("parsed address differs from the one made from key")
+	}
+	if addr.String() != onionAddress {
+		t.Errorf("wrong string form %s", addr)
+	}
+	if !bytes.Equal(addr.PublicKey(), pk) {
+		t.Error("wrong public key")
+	}
+	decoded, err := Base32Decode(onionAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(addr.Bytes(), decoded) {
+		t.Error("wrong binary form")
+	}
+
+	var config struct {
+		Service AddressV3
+	}
+	config.Service = addr
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"Service":"`+onionAddress+`"}` {
+		t.Errorf("unexpected JSON %s", data)
+	}
+	config.Service = AddressV3{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Service != addr {
+		t.Error("address changed after JSON round trip")
+	}
+
+	for _, s := range []string{"", "expyuzz4wqqyqhjn", onionAddress[:55] + "a"} {
+		if _, err := ParseOnionAddressV3(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"Service":"expyuzz4wqqyqhjn"}`), &config); err == nil {
+		t.Error("invalid address is unmarshaled")
+	}
+}
+
+func TestAddressV2(t *testing.T) {
+	sk := testPrivateKey(t)
+	onionAddress, err := OnionAddressV2(&sk.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := ParseOnionAddressV2(strings.ToUpper(onionAddress) + ".onion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromKey, err := AddressV2FromKey(&sk.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != fromKey {
+		t.Error("parsed address differs from the one made from key")
+	}
+	if addr.String() != onionAddress {
+		t.Errorf("wrong string form %s", addr)
+	}
+	permID, _ := CalcPermanentID(&sk.PublicKey)
+	if !bytes.Equal(addr.PermanentID(), permID) {
+		t.Error("wrong permanent id")
+	}
+	if !addr.MatchesKey(&sk.PublicKey) {
+		t.Error("address doesn't match its key")
+	}
+	other, _ := ParseOnionAddressV2("expyuzz4wqqyqhjn")
+	if other.MatchesKey(&sk.PublicKey) {
+		t.Error("foreign address matches the key")
+	}
+
+	text, err := addr.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshaled AddressV2
+	if err := unmarshaled.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshaled != addr {
+		t.Error("address changed after text round trip")
+	}
+
+	for _, s := range []string{"", "hartwell", "expyuzz4wqqyqhj1", "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd"} {
+		if _, err := ParseOnionAddressV2(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// clientauth.go - deal with client authorization of onion services
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// AuthType is a type of client authorization of v2 onion services.
+type AuthType byte
+
+const (
+	AuthTypeNone    AuthType = 0
+	AuthTypeBasic   AuthType = 1
+	AuthTypeStealth AuthType = 2
+)
+
+func (at AuthType) String() string {
+	switch at {
+	case AuthTypeNone:
+		return "none"
+	case AuthTypeBasic:
+		return "basic"
+	case AuthTypeStealth:
+		return "stealth"
+	default:
+		return fmt.Sprintf("AuthType(%d)", byte(at))
+	}
+}
+
+// DetectAuthType detects client authorization type of introduction points
+// block. Encrypted blocks start with the authorization type byte while
+// plaintext ones start with "introduction-point" keyword.
+func DetectAuthType(block []byte) (AuthType, error) {
+	if len(block) == 0 || block[0] == 'i' {
+		return AuthTypeNone, nil
+	}
+	switch at := AuthType(block[0]); at {
+	case AuthTypeBasic, AuthTypeStealth:
+		return at, nil
+	default:
+		return at, fmt.Errorf("unknown client authorization type %d", byte(at))
+	}
+}
+
+// DescriptorCookieLength is the length of descriptor cookie used for
+// client authorization.
+const DescriptorCookieLength = 16
+
+// descriptorCookieEncodedLength is the length of base64-encoded cookie
+// with authorization type as tor represents it.
+const descriptorCookieEncodedLength = 22
+
+// EncodeDescriptorCookie encodes cookie along with authType exactly as
+// tor does for "HidServAuth" lines: base64 of the cookie followed by
+// a byte holding authType-1 in the high nibble, without trailing "A=".
+func EncodeDescriptorCookie(cookie []byte, authType AuthType) (string, error) {
+	if len(cookie) != DescriptorCookieLength {
+		return "", fmt.Errorf("invalid descriptor cookie length %d", len(cookie))
+	}
+	if authType != AuthTypeBasic && authType != AuthTypeStealth {
+		return "", fmt.Errorf("invalid client authorization type %v", authType)
+	}
+	buf := append(append([]byte{}, cookie...), byte(authType-1)<<4)
+	return base64.StdEncoding.EncodeToString(buf)[:descriptorCookieEncodedLength], nil
+}
+
+// GenerateDescriptorCookie generates a random descriptor cookie for
+// client authorization of type authType. It returns the raw cookie and
+// its encoding to use in tor configuration.
+func GenerateDescriptorCookie(authType AuthType) (cookie []byte, encoded string, err error) {
+	cookie = make([]byte, DescriptorCookieLength)
+	if _, err := io.ReadFull(rand.Reader, cookie); err != nil {
+		return nil, "", err
+	}
+	encoded, err = EncodeDescriptorCookie(cookie, authType)
+	if err != nil {
+		return nil, "", err
+	}
+	return cookie, encoded, nil
+}
+
+// ParseDescriptorCookie decodes descriptor cookie s as found in
+// "HidServAuth" lines of tor configuration and extracts authorization
+// type embedded in it.
+func ParseDescriptorCookie(s string) (cookie []byte, authType AuthType, err error) {
+	s = strings.TrimSpace(s)
+	if len(s) != descriptorCookieEncodedLength {
+		return nil, 0, fmt.Errorf("invalid descriptor cookie length %d", len(s))
+	}
+	buf, err := base64.StdEncoding.DecodeString(s + "A=")
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid descriptor cookie: %v", err)
+	}
+	authType = AuthType(buf[DescriptorCookieLength]>>4) + 1
+	if authType != AuthTypeBasic && authType != AuthTypeStealth {
+		return nil, 0, fmt.Errorf("invalid client authorization type %d in descriptor cookie", byte(authType))
+	}
+	return buf[:DescriptorCookieLength], authType, nil
+}
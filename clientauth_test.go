@@ -0,0 +1,113 @@
+package onionutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestDetectAuthType(t *testing.T) {
+	desc, err := NewOnionDescriptor(&testPrivateKey(t).PublicKey, testIntroPoints(t, 1), 0, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := desc.IntropointsBlock
+	for _, authType := range []AuthType{AuthTypeNone, AuthTypeBasic, AuthTypeStealth} {
+		if authType == AuthTypeNone {
+			desc.IntropointsBlock = plaintext
+		} else {
+			desc.IntropointsBlock = append([]byte{byte(authType)}, testBytes(0, 64)...)
+		}
+		if err := desc.Sign(testPrivateKey(t)); err != nil {
+			t.Fatal(err)
+		}
+		descs, _ := ParseOnionDescriptors(desc.Bytes())
+		if len(descs) != 1 {
+			t.Fatalf("%v: descriptor is not parsed", authType)
+		}
+		if descs[0].AuthType != authType {
+			t.Errorf("expected %v, got %v", authType, descs[0].AuthType)
+		}
+		if string(descs[0].IntropointsBlock) != string(desc.IntropointsBlock) {
+			t.Errorf("%v: introduction points block is not preserved", authType)
+		}
+		identities := descs[0].IntroPointIdentities()
+		if authType == AuthTypeNone && len(identities) != 1 {
+			t.Errorf("plaintext introduction points are not parsed")
+		}
+		if authType != AuthTypeNone && identities != nil {
+			t.Errorf("%v: encrypted introduction points are parsed", authType)
+		}
+	}
+	if _, err := DetectAuthType([]byte{3, 0, 0}); err == nil {
+		t.Error("no error for unknown authorization type")
+	}
+}
+
+func TestGenerateDescriptorCookie(t *testing.T) {
+	for _, authType := range []AuthType{AuthTypeBasic, AuthTypeStealth} {
+		cookie, encoded, err := GenerateDescriptorCookie(authType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cookie) != DescriptorCookieLength || len(encoded) != 22 {
+			t.Fatalf("%v: wrong lengths %d, %d", authType, len(cookie), len(encoded))
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded + "A=")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded[:DescriptorCookieLength], cookie) {
+			t.Errorf("%v: encoding doesn't hold the cookie", authType)
+		}
+		if AuthType(decoded[DescriptorCookieLength]>>4)+1 != authType {
+			t.Errorf("%v: wrong authorization type bits", authType)
+		}
+	}
+	encoded, err := EncodeDescriptorCookie(testBytes(0, 16), AuthTypeStealth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded != "AAECAwQFBgcICQoLDA0ODx" {
+		t.Errorf("unexpected encoding %s", encoded)
+	}
+	if _, _, err := GenerateDescriptorCookie(AuthTypeNone); err == nil {
+		t.Error("cookie is generated for no authorization")
+	}
+}
+
+func TestParseDescriptorCookie(t *testing.T) {
+	for _, tc := range []struct {
+		encoded  string
+		authType AuthType
+	}{
+		{"AAECAwQFBgcICQoLDA0ODw", AuthTypeBasic},
+		{"AAECAwQFBgcICQoLDA0ODx", AuthTypeStealth},
+		{"AAECAwQFBgcICQoLDA0ODx\n", AuthTypeStealth},
+	} {
+		cookie, authType, err := ParseDescriptorCookie(tc.encoded)
+		if err != nil {
+			t.Errorf("%q: %v", tc.encoded, err)
+			continue
+		}
+		if !bytes.Equal(cookie, testBytes(0, 16)) || authType != tc.authType {
+			t.Errorf("%q: got %x, %v", tc.encoded, cookie, authType)
+		}
+	}
+	for _, authType := range []AuthType{AuthTypeBasic, AuthTypeStealth} {
+		cookie, encoded, err := GenerateDescriptorCookie(authType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, parsedType, err := ParseDescriptorCookie(encoded)
+		if err != nil || !bytes.Equal(parsed, cookie) || parsedType != authType {
+			t.Errorf("%v: round trip failed: %v", authType, err)
+		}
+	}
+	for _, s := range []string{"", "AAECAwQFBgcICQoLDA0OD", "AAECAwQFBgcICQoLDA0ODy", "AAECAwQFBgcICQoLDA0O!x"} {
+		if _, _, err := ParseDescriptorCookie(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
@@ -10,15 +10,20 @@ package onionutil
 import (
 	"bytes"
 	"crypto"
-	"crypto/sha1"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base32"
 	"encoding/binary"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"reflect"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/nogoegst/onionutil/pkcs1"
 	"github.com/nogoegst/onionutil/torparse"
 )
 
@@ -27,26 +32,101 @@ const (
 	NTorOnionKeySize      = 32
 )
 
+// HashType is the hash function of all v2 constructions.
 const HashType = crypto.SHA1
 
+// Hash returns HashType digest of data. Package code uses purpose-named
+// wrappers around it.
 func Hash(data []byte) (hash []byte) {
-	h := sha1.New()
+	h := HashType.New()
 	h.Write(data)
 	hash = h.Sum(nil)
 	return hash
 }
 
+const base32Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567abcdefghijklmnopqrstuvwxyz"
+
+// onionBase32 is the lowercase base32 encoding onion addresses use. It
+// saves case conversions in the common case.
+var onionBase32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567")
+
 /* XXX: here might be an error for new ed25519 addresses (! mod 5bits=0) */
 func Base32Encode(binary []byte) string {
-	hb32 := base32.StdEncoding.EncodeToString(binary)
-	return strings.ToLower(hb32)
+	var buf [64]byte
+	dst := buf[:0]
+	if n := onionBase32.EncodedLen(len(binary)); n <= len(buf) {
+		dst = buf[:n]
+	} else {
+		dst = make([]byte, n)
+	}
+	onionBase32.Encode(dst, binary)
+	return string(dst)
+}
+
+// asciiLower converts ASCII letters of s to lowercase. Unlike
+// strings.ToLower it leaves non-ASCII characters (like Kelvin sign)
+// intact so they aren't mistaken for base32 ones.
+func asciiLower(s string) string {
+	for i := 0; i < len(s); i++ {
+		if 'A' <= s[i] && s[i] <= 'Z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if 'A' <= b[j] && b[j] <= 'Z' {
+					b[j] += 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return s
 }
 
 func Base32Decode(b32 string) (binary []byte, err error) {
-	binary, err = base32.StdEncoding.DecodeString(strings.ToUpper(b32))
+	binary, err = onionBase32.DecodeString(asciiLower(b32))
+	if e, ok := err.(base32.CorruptInputError); ok {
+		pos := int(e)
+		if pos < len(b32) {
+			r, _ := utf8.DecodeRuneInString(b32[pos:])
+			if !strings.ContainsRune(base32Alphabet, r) {
+				return binary, fmt.Errorf("invalid base32 character %q at position %d", r, pos)
+			}
+		}
+		return binary, fmt.Errorf("invalid base32 length %d", len(b32))
+	}
 	return binary, err
 }
 
+// EncodeKeyBlock encodes pk into PEM block exactly as tor does: PKCS#1 DER
+// sequence in base64 wrapped at 64 columns between
+// "-----BEGIN RSA PUBLIC KEY-----" and "-----END RSA PUBLIC KEY-----" lines.
+// Keys are part of signed documents, so any divergence changes digests.
+func EncodeKeyBlock(pk *rsa.PublicKey) ([]byte, error) {
+	der, err := pkcs1.EncodePublicKeyDER(pk)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: der}), nil
+}
+
+// decodePublicKey decodes RSA public key from the contents of a key
+// block. Besides tor's PKCS#1 form ("RSA PUBLIC KEY") it accepts PKIX
+// SubjectPublicKeyInfo that some producers emit under "PUBLIC KEY" label.
+func decodePublicKey(der []byte) (*rsa.PublicKey, error) {
+	pk, _, err := pkcs1.DecodePublicKeyDER(der)
+	if err == nil {
+		return pk, nil
+	}
+	pub, pkixErr := x509.ParsePKIXPublicKey(der)
+	if pkixErr != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return rsaPub, nil
+}
+
 func InetPortFromByteString(str []byte) (port uint16, err error) {
 	p, err := strconv.ParseUint(string(str), 10, 16)
 	return uint16(p), err
@@ -153,7 +233,16 @@ type Certificate struct {
 	PubkeySign     bool
 }
 
+// certHeaderLength is the length of fixed part of Ed25519 certificate
+// preceding its extensions.
+const certHeaderLength = 1 + 1 + 4 + 1 + Ed25519PubkeySize + 1
+
+var errCertTruncated = errors.New("certificate is truncated")
+
 func ParseCertFromBytes(binCert []byte) (cert Certificate, err error) {
+	if len(binCert) < certHeaderLength+Ed25519SignatureSize {
+		return cert, errCertTruncated
+	}
 	i := 0 /* Index */
 	cert.Version = uint8(binCert[i])
 	i += 1
@@ -173,17 +262,26 @@ func ParseCertFromBytes(binCert []byte) (cert Certificate, err error) {
 	cert.Extensions = make(map[ExtType]Extension)
 	for e := 0; e < int(cert.NExtensions); e++ {
 		var extension Extension
+		if len(binCert) < i+4 {
+			return cert, errCertTruncated
+		}
 		extLength := int(binary.BigEndian.Uint16(binCert[i : i+2]))
 		i += 2
 		extension.Type = ExtType(binCert[i])
 		i += 1
 		extension.Flags = binCert[i]
 		i += 1
+		if len(binCert) < i+extLength {
+			return cert, errCertTruncated
+		}
 		extension.Data = binCert[i : i+extLength]
 		i += extLength
 		/* We assume that there are no duplicates by ExtType */
 		cert.Extensions[extension.Type] = extension
 	}
+	if len(binCert) != i+Ed25519SignatureSize {
+		return cert, fmt.Errorf("certificate has %d bytes after extensions instead of signature", len(binCert)-i)
+	}
 	copy(cert.Signature[:], binCert[i:i+Ed25519SignatureSize])
 	i += Ed25519SignatureSize
 	return
@@ -0,0 +1,119 @@
+package onionutil
+
+import (
+	"bytes"
+	"encoding/base32"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestBase32DecodeErrors(t *testing.T) {
+	vectors := []struct {
+		input string
+		err   string
+	}{
+		{"expyuzz1wqqyqhjn", "invalid base32 character '1' at position 7"},
+		{"0xpyuzz4wqqyqhjn", "invalid base32 character '0' at position 0"},
+		{"expyuzz4wqqyqhj!", "invalid base32 character '!' at position 15"},
+		{"expyuzz\u212awqqyqhjn", "invalid base32 character '\u212a' at position 7"},
+		{"expyuzz4wqqyqhj", "invalid base32 length 15"},
+	}
+	for _, v := range vectors {
+		_, err := Base32Decode(v.input)
+		if err == nil {
+			t.Errorf("%s: no error", v.input)
+			continue
+		}
+		if err.Error() != v.err {
+			t.Errorf("%s: expected %q, got %q", v.input, v.err, err)
+		}
+	}
+	if _, err := Base32Decode("expyuzz4wqqyqhjn"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncodeKeyBlock(t *testing.T) {
+	golden, err := ioutil.ReadFile("test/descriptors/hartwellnogoegst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := bytes.Index(golden, []byte("permanent-key\n")) + len("permanent-key\n")
+	end := bytes.Index(golden, []byte("secret-id-part "))
+	torBlock := golden[start:end]
+
+	descs, _ := ParseOnionDescriptors(golden)
+	if len(descs) != 1 {
+		t.Fatalf("expected 1 descriptor, got %d", len(descs))
+	}
+	block, err := EncodeKeyBlock(descs[0].PermanentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block, torBlock) {
+		t.Fatalf("key block differs from tor's:\n%s\n%s", block, torBlock)
+	}
+}
+
+func BenchmarkBase32EncodeV2(b *testing.B) {
+	benchmarkBase32Encode(b, testBytes(0, OnionAddressLengthV2))
+}
+
+func BenchmarkBase32EncodeV3(b *testing.B) {
+	benchmarkBase32Encode(b, testBytes(0, OnionAddressLengthV3))
+}
+
+func benchmarkBase32Encode(b *testing.B, data []byte) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Base32Encode(data)
+	}
+}
+
+func BenchmarkBase32DecodeV2(b *testing.B) {
+	benchmarkBase32Decode(b, "expyuzz4wqqyqhjn")
+}
+
+func BenchmarkBase32DecodeV3(b *testing.B) {
+	benchmarkBase32Decode(b, "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd")
+}
+
+func benchmarkBase32Decode(b *testing.B, s string) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Base32Decode(s); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func FuzzBase32(f *testing.F) {
+	for _, s := range []string{"", "expyuzz4wqqyqhjn", "EXPYUZZ4WQQYQHJN", "ExPyUzz4wqqyqhjn",
+		"pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd", "mfrgg===", "expyuzz1", "K"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		data := []byte(s)
+		if encoded := Base32Encode(data); encoded != strings.ToLower(base32.StdEncoding.EncodeToString(data)) {
+			t.Fatalf("%x: encoding %q differs from stdlib", data, encoded)
+		}
+
+		decoded, err := Base32Decode(s)
+		isASCII := strings.IndexFunc(s, func(r rune) bool { return r >= utf8.RuneSelf }) < 0
+		if !isASCII {
+			if err == nil {
+				t.Fatalf("%q: non-ASCII input is decoded", s)
+			}
+			return
+		}
+		stdDecoded, stdErr := base32.StdEncoding.DecodeString(strings.ToUpper(s))
+		if (err == nil) != (stdErr == nil) {
+			t.Fatalf("%q: error %v differs from stdlib %v", s, err, stdErr)
+		}
+		if err == nil && !bytes.Equal(decoded, stdDecoded) {
+			t.Fatalf("%q: decoding differs from stdlib", s)
+		}
+	})
+}
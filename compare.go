@@ -0,0 +1,192 @@
+// compare.go - compare descriptors against reference ones
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/nogoegst/onionutil/pkcs1"
+)
+
+// Difference describes a mismatch of a field between two documents.
+// Ours and Theirs hold raw text of the field (including its object) or
+// are empty if the field is absent.
+type Difference struct {
+	Field  string
+	Ours   string
+	Theirs string
+	Reason string
+}
+
+func (d Difference) String() string {
+	return fmt.Sprintf("%s: %s", d.Field, d.Reason)
+}
+
+type rawField struct {
+	keyword string
+	text    string
+}
+
+// splitRawFields splits document data into fields keeping their exact text.
+func splitRawFields(data []byte) (fields []rawField) {
+	inObject := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		if inObject || strings.HasPrefix(line, "-----BEGIN ") {
+			inObject = !strings.HasPrefix(line, "-----END ")
+			if len(fields) > 0 {
+				fields[len(fields)-1].text += line
+				continue
+			}
+		}
+		keyword := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == '\r' || r == '\n'
+		})
+		if len(keyword) == 0 {
+			fields = append(fields, rawField{"", line})
+			continue
+		}
+		fields = append(fields, rawField{keyword[0], line})
+	}
+	return fields
+}
+
+// CompareToReference compares descriptor text ours against a reference one
+// (e.g. produced by tor) theirs field by field. It reports whether they are
+// byte-for-byte equal and, if not, where exactly they differ.
+func CompareToReference(ours, theirs []byte) (bool, []Difference) {
+	if bytes.Equal(ours, theirs) {
+		return true, nil
+	}
+	ourFields := splitRawFields(ours)
+	theirFields := splitRawFields(theirs)
+	var diffs []Difference
+
+	var ourOrder, theirOrder []string
+	ourByKeyword := make(map[string][]rawField)
+	for _, f := range ourFields {
+		ourOrder = append(ourOrder, f.keyword)
+		ourByKeyword[f.keyword] = append(ourByKeyword[f.keyword], f)
+	}
+	seen := make(map[string]int)
+	for _, f := range theirFields {
+		theirOrder = append(theirOrder, f.keyword)
+		n := seen[f.keyword]
+		seen[f.keyword]++
+		if n >= len(ourByKeyword[f.keyword]) {
+			diffs = append(diffs, Difference{f.keyword, "", f.text, "missing in ours"})
+			continue
+		}
+		our := ourByKeyword[f.keyword][n]
+		if our.text == f.text {
+			continue
+		}
+		reason := "value differs"
+		if strings.Join(strings.Fields(our.text), " ") == strings.Join(strings.Fields(f.text), " ") {
+			reason = "whitespace differs"
+		}
+		diffs = append(diffs, Difference{f.keyword, our.text, f.text, reason})
+	}
+	for _, f := range ourFields {
+		if seen[f.keyword] > 0 {
+			seen[f.keyword]--
+			continue
+		}
+		diffs = append(diffs, Difference{f.keyword, f.text, "", "missing in theirs"})
+	}
+	if len(diffs) == 0 && !reflect.DeepEqual(ourOrder, theirOrder) {
+		diffs = append(diffs, Difference{Reason: "field order differs"})
+	}
+	return false, diffs
+}
+
+// publicKeysEqual reports whether a and b have the same DER encoding.
+func publicKeysEqual(a, b *rsa.PublicKey) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	aDER, err := pkcs1.EncodePublicKeyDER(a)
+	if err != nil {
+		return false
+	}
+	bDER, err := pkcs1.EncodePublicKeyDER(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aDER, bDER)
+}
+
+// EqualContent reports whether desc and other are functionally identical,
+// i.e. equal in everything but signature. Publication times are compared
+// by time period and introduction points by IntroductionPoint.Equal
+// (raw blocks are compared if introduction points aren't decoded).
+func (desc OnionDescriptor) EqualContent(other OnionDescriptor) bool {
+	if desc.DescID != other.DescID ||
+		desc.Version != other.Version ||
+		desc.Lifetime != other.Lifetime ||
+		!bytes.Equal(desc.SecretIDPart, other.SecretIDPart) ||
+		!reflect.DeepEqual(desc.ProtocolVersions, other.ProtocolVersions) ||
+		desc.AuthType != other.AuthType {
+		return false
+	}
+	if !publicKeysEqual(desc.PermanentKey, other.PermanentKey) {
+		return false
+	}
+	if desc.PermanentKey != nil {
+		permID, err := CalcPermanentID(desc.PermanentKey)
+		if err != nil {
+			return false
+		}
+		if CalcTimePeriod(permID, desc.PublicationTime) != CalcTimePeriod(permID, other.PublicationTime) {
+			return false
+		}
+	} else if !desc.PublicationTime.Equal(other.PublicationTime) {
+		return false
+	}
+	if desc.introPointsDecoded && other.introPointsDecoded {
+		if len(desc.IntroductionPoints) != len(other.IntroductionPoints) {
+			return false
+		}
+		for i := range desc.IntroductionPoints {
+			if !desc.IntroductionPoints[i].Equal(other.IntroductionPoints[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return bytes.Equal(desc.IntropointsBlock, other.IntropointsBlock)
+}
+
+// FreshestDescriptor returns the descriptor with the latest publication
+// time among descs that belong to the same service (see SameService) as
+// the first valid one. Descriptors that fail Verify are ignored,
+// so forged descriptors with far future publication times can't shadow
+// genuine ones. It returns false if there are no valid descriptors.
+func FreshestDescriptor(descs []OnionDescriptor) (OnionDescriptor, bool) {
+	var freshest OnionDescriptor
+	found := false
+	for i := range descs {
+		desc := &descs[i]
+		if found && !SameService(freshest, *desc) {
+			continue
+		}
+		if err := desc.Verify(); err != nil {
+			continue
+		}
+		if !found || desc.PublicationTime.After(freshest.PublicationTime) {
+			freshest, found = *desc, true
+		}
+	}
+	return freshest, found
+}
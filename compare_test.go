@@ -0,0 +1,165 @@
+package onionutil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompareToReference(t *testing.T) {
+	theirs, err := ioutil.ReadFile("test/descriptors/hartwellnogoegst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs, _ := ParseOnionDescriptors(theirs)
+	if len(descs) != 1 {
+		t.Fatalf("expected 1 descriptor, got %d", len(descs))
+	}
+	ours := descs[0].Bytes()
+	if equal, diffs := CompareToReference(ours, theirs); !equal || diffs != nil {
+		t.Fatalf("equal descriptors differ: %v", diffs)
+	}
+
+	vectors := []struct {
+		ours   []byte
+		field  string
+		reason string
+	}{
+		{
+			bytes.Replace(ours, []byte("publication-time 2016-06-21 20:00:00"), []byte("publication-time 2016-06-21T20:00:00"), 1),
+			"publication-time", "value differs",
+		},
+		{
+			bytes.Replace(ours, []byte("protocol-versions 2,3\n"), []byte("protocol-versions 2,3 \n"), 1),
+			"protocol-versions", "whitespace differs",
+		},
+		{
+			bytes.Replace(ours, []byte("version 2\n"), nil, 1),
+			"version", "missing in ours",
+		},
+		{
+			bytes.Replace(ours, []byte("version 2\n"), []byte("version 2\nextra-field\n"), 1),
+			"extra-field", "missing in theirs",
+		},
+		{
+			bytes.Replace(ours, []byte("PUBLIC KEY-----\nMIGKAoGBANGR"), []byte("PUBLIC KEY-----\nMIGKAoGBANGS"), 1),
+			"permanent-key", "value differs",
+		},
+	}
+	for _, v := range vectors {
+		equal, diffs := CompareToReference(v.ours, theirs)
+		if equal || len(diffs) != 1 {
+			t.Errorf("%s: expected exactly one difference, got %v", v.field, diffs)
+			continue
+		}
+		if diffs[0].Field != v.field || diffs[0].Reason != v.reason {
+			t.Errorf("%s: unexpected difference %v", v.field, diffs[0])
+		}
+	}
+
+	swapped := bytes.Replace(ours, []byte("rendezvous-service-descriptor 6iedtc4w36h35ln3ntklmbiawjhgdjud\nversion 2\n"),
+		[]byte("version 2\nrendezvous-service-descriptor 6iedtc4w36h35ln3ntklmbiawjhgdjud\n"), 1)
+	equal, diffs := CompareToReference(swapped, theirs)
+	if equal || len(diffs) != 1 || diffs[0].Reason != "field order differs" {
+		t.Errorf("field order difference is not detected: %v", diffs)
+	}
+}
+
+func TestEqualContent(t *testing.T) {
+	sk := testPrivateKey(t)
+	now := time.Unix(1466539200, 0)
+	desc, err := NewOnionDescriptor(&sk.PublicKey, testIntroPoints(t, 3), 0, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := desc.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	descs, _, err := new(Parser).ParseOnionDescriptors(desc.Bytes())
+	if err != nil || len(descs) != 1 {
+		t.Fatalf("unable to parse descriptor: %v", err)
+	}
+	parsed := descs[0]
+	if !desc.EqualContent(parsed) || !parsed.EqualContent(*desc) {
+		t.Fatal("parsed descriptor differs")
+	}
+
+	other := parsed
+	other.Signature = []byte("resigned")
+	permID, _ := CalcPermanentID(&sk.PublicKey)
+	other.PublicationTime = timePeriodStart(permID, CalcTimePeriod(permID, now)).Add(time.Second)
+	if !desc.EqualContent(other) {
+		t.Error("descriptors differing in signature and publication time within period are not equal")
+	}
+
+	skipped, _, _ := (&Parser{SkipIntroPoints: true}).ParseOnionDescriptors(desc.Bytes())
+	if !skipped[0].EqualContent(parsed) {
+		t.Error("raw introduction points block differs")
+	}
+
+	for name, modify := range map[string]func(d *OnionDescriptor){
+		"version":           func(d *OnionDescriptor) { d.Version = 3 },
+		"protocol versions": func(d *OnionDescriptor) { d.ProtocolVersions = []int{2} },
+		"time period": func(d *OnionDescriptor) {
+			d.PublicationTime = d.PublicationTime.Add(TimePeriodLength * time.Second)
+		},
+		"introduction points": func(d *OnionDescriptor) {
+			d.IntroductionPoints = append([]IntroductionPoint{}, d.IntroductionPoints...)
+			d.IntroductionPoints[1].OnionPort++
+		},
+		"permanent key": func(d *OnionDescriptor) {
+			d.PermanentKey = &rsa.PublicKey{N: d.PermanentKey.N, E: 3}
+		},
+	} {
+		other := parsed
+		modify(&other)
+		if desc.EqualContent(other) {
+			t.Errorf("descriptors differing in %s are equal", name)
+		}
+	}
+}
+
+func TestFreshestDescriptor(t *testing.T) {
+	if _, ok := FreshestDescriptor(nil); ok {
+		t.Fatal("descriptor is found among none")
+	}
+	sk := testPrivateKey(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1466539200, 0)
+	build := func(sk *rsa.PrivateKey, hours int, sign bool) OnionDescriptor {
+		desc, err := NewOnionDescriptor(&sk.PublicKey, nil, hours%2, start.Add(time.Duration(hours)*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sign {
+			if err := desc.Sign(sk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return *desc
+	}
+	descs := []OnionDescriptor{
+		build(sk, 1, true),
+		build(otherKey, 5, true),
+		build(sk, 3, true),
+		build(sk, 9, false),
+		build(sk, 2, true),
+	}
+	freshest, ok := FreshestDescriptor(descs)
+	if !ok {
+		t.Fatal("no descriptor is found")
+	}
+	if !reflect.DeepEqual(freshest, descs[2]) {
+		t.Errorf("wrong descriptor published at %v", freshest.PublicationTime)
+	}
+	if _, ok := FreshestDescriptor(descs[3:4]); ok {
+		t.Error("unsigned descriptor is returned")
+	}
+}
@@ -0,0 +1,202 @@
+// control.go - deal with tor's control protocol
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nogoegst/onionutil/pkcs1"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	ControlKeyTypeRSA1024   = "RSA1024"
+	ControlKeyTypeED25519V3 = "ED25519-V3"
+)
+
+// ExpandedEd25519PrivateKey is an Ed25519 private key in the expanded
+// form (clamped scalar followed by hash prefix) tor uses for v3 onion
+// services. It can't be converted back to the seed.
+type ExpandedEd25519PrivateKey []byte
+
+// ExpandedEd25519PrivateKeySize is the size of ExpandedEd25519PrivateKey.
+const ExpandedEd25519PrivateKeySize = 64
+
+// ExpandEd25519PrivateKey converts sk into the expanded form.
+func ExpandEd25519PrivateKey(sk ed25519.PrivateKey) ExpandedEd25519PrivateKey {
+	h := sha512.Sum512(sk[:32])
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	return ExpandedEd25519PrivateKey(h[:])
+}
+
+// ParseAddOnionResponse parses reply lines of ADD_ONION control command
+// into onion service ID and, if present, its private key. The key is either
+// *rsa.PrivateKey or ExpandedEd25519PrivateKey.
+func ParseAddOnionResponse(lines []string) (serviceID string, key crypto.PrivateKey, err error) {
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) >= 4 && strings.HasPrefix(line, "250") {
+			line = line[4:]
+		} else if strings.HasPrefix(line, "5") {
+			return "", nil, fmt.Errorf("ADD_ONION failed: %s", line)
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "ServiceID":
+			serviceID = kv[1]
+			if !OnionAddressIsValid(serviceID) {
+				return "", nil, fmt.Errorf("invalid service ID %q", serviceID)
+			}
+		case "PrivateKey":
+			key, err = DecodeControlKeyBlob(kv[1])
+			if err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	if serviceID == "" {
+		return "", nil, errors.New("no ServiceID in ADD_ONION response")
+	}
+	return serviceID, key, nil
+}
+
+// DecodeControlKeyBlob decodes private key blob of the form
+// "<KeyType>:<KeyBlob>" as used by tor's control protocol.
+func DecodeControlKeyBlob(blob string) (crypto.PrivateKey, error) {
+	kv := strings.SplitN(blob, ":", 2)
+	if len(kv) != 2 {
+		return nil, errors.New("malformed key blob")
+	}
+	der, err := base64.StdEncoding.DecodeString(kv[1])
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode key blob: %v", err)
+	}
+	switch kv[0] {
+	case ControlKeyTypeRSA1024:
+		sk, _, err := pkcs1.DecodePrivateKeyDER(der)
+		if err != nil {
+			return nil, err
+		}
+		return sk, nil
+	case ControlKeyTypeED25519V3:
+		if len(der) != ExpandedEd25519PrivateKeySize {
+			return nil, errors.New("wrong ED25519-V3 key length")
+		}
+		return ExpandedEd25519PrivateKey(der), nil
+	default:
+		return nil, fmt.Errorf("unrecognized key type %q", kv[0])
+	}
+}
+
+// EncodeControlKeyBlob encodes private key into "<KeyType>:<KeyBlob>" form
+// suitable for ADD_ONION control command. Supported key types are
+// *rsa.PrivateKey, ed25519.PrivateKey and ExpandedEd25519PrivateKey.
+func EncodeControlKeyBlob(key crypto.PrivateKey) (string, error) {
+	var keyType string
+	var blob []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		der, err := pkcs1.EncodePrivateKeyDER(key)
+		if err != nil {
+			return "", err
+		}
+		keyType, blob = ControlKeyTypeRSA1024, der
+	case ed25519.PrivateKey:
+		keyType, blob = ControlKeyTypeED25519V3, ExpandEd25519PrivateKey(key)
+	case ExpandedEd25519PrivateKey:
+		if len(key) != ExpandedEd25519PrivateKeySize {
+			return "", errors.New("wrong expanded Ed25519 key length")
+		}
+		keyType, blob = ControlKeyTypeED25519V3, key
+	default:
+		return "", errors.New("Unrecognized type of private key")
+	}
+	return keyType + ":" + base64.StdEncoding.EncodeToString(blob), nil
+}
+
+// HSPOSTOptions holds optional arguments of HSPOST control command.
+type HSPOSTOptions struct {
+	// Servers are directory servers to upload the descriptor to, as
+	// LongNames ("$" followed by hex fingerprint and optionally by
+	// "~" or "=" and nickname). If empty, tor picks responsible HSDirs.
+	Servers []string
+	// HSAddress is the v3 onion address the descriptor belongs to.
+	HSAddress string
+}
+
+// EncodeHSPOST encodes HSPOST control command that uploads descriptor desc
+// with options opts. HSPOST is a multi-line command: desc is sent with
+// CRLF line endings and lines starting with "." are escaped with another
+// one, followed by a line with a single ".".
+func EncodeHSPOST(desc []byte, opts HSPOSTOptions) (string, error) {
+	if len(bytes.TrimSpace(desc)) == 0 {
+		return "", errors.New("empty descriptor")
+	}
+	var b strings.Builder
+	b.WriteString("+HSPOST")
+	for _, server := range opts.Servers {
+		if !isLongName(server) {
+			return "", fmt.Errorf("invalid server %q", server)
+		}
+		b.WriteString(" SERVER=" + server)
+	}
+	if opts.HSAddress != "" {
+		address := NormalizeOnionAddress(opts.HSAddress)
+		if !OnionAddressIsValidV3(address) {
+			return "", fmt.Errorf("invalid v3 onion address %q", opts.HSAddress)
+		}
+		b.WriteString(" HSADDRESS=" + address)
+	}
+	b.WriteString("\r\n")
+	lines := strings.Split(strings.TrimSuffix(string(desc), "\n"), "\n")
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(line, ".") {
+			b.WriteString(".")
+		}
+		b.WriteString(line + "\r\n")
+	}
+	b.WriteString(".\r\n")
+	return b.String(), nil
+}
+
+// isLongName reports whether s is a relay LongName: "$" followed by hex
+// fingerprint and optionally by "~" or "=" and nickname.
+func isLongName(s string) bool {
+	if !strings.HasPrefix(s, "$") {
+		return false
+	}
+	s = s[1:]
+	fingerprint, nickname := s, ""
+	if i := strings.IndexAny(s, "~="); i >= 0 {
+		fingerprint, nickname = s[:i], s[i+1:]
+		if nickname == "" || len(nickname) > 19 {
+			return false
+		}
+		for _, c := range nickname {
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+				return false
+			}
+		}
+	}
+	decoded, err := hex.DecodeString(fingerprint)
+	return err == nil && len(decoded) == IdentityLength
+}
@@ -0,0 +1,157 @@
+package onionutil
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nogoegst/onionutil/pkcs1"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestParseAddOnionResponse(t *testing.T) {
+	sk := testPrivateKey(t)
+	der, err := pkcs1.EncodePrivateKeyDER(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion, err := OnionAddress(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{
+		"250-ServiceID=" + onion,
+		"250-PrivateKey=RSA1024:" + base64.StdEncoding.EncodeToString(der),
+		"250 OK",
+	}
+	serviceID, key, err := ParseAddOnionResponse(lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serviceID != onion {
+		t.Errorf("wrong service id %s", serviceID)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok || rsaKey.N.Cmp(sk.N) != 0 {
+		t.Errorf("wrong private key")
+	}
+
+	expanded := testBytes(0, 64)
+	lines = []string{
+		"250-ServiceID=pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd",
+		"250-PrivateKey=ED25519-V3:" + base64.StdEncoding.EncodeToString(expanded),
+		"250 OK",
+	}
+	_, key, err = ParseAddOnionResponse(lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(key, ExpandedEd25519PrivateKey(expanded)) {
+		t.Errorf("wrong private key")
+	}
+
+	_, key, err = ParseAddOnionResponse([]string{"250-ServiceID=" + onion, "250 OK"})
+	if err != nil || key != nil {
+		t.Errorf("unexpected result for response without key: %v, %v", key, err)
+	}
+	if _, _, err := ParseAddOnionResponse([]string{"512 Bad arguments to ADD_ONION"}); err == nil {
+		t.Errorf("no error for failure response")
+	}
+	if _, _, err := ParseAddOnionResponse([]string{"250-ServiceID=" + onion, "250-PrivateKey=X:AAAA", "250 OK"}); err == nil {
+		t.Errorf("no error for unknown key type")
+	}
+}
+
+func TestEncodeControlKeyBlob(t *testing.T) {
+	sk := testPrivateKey(t)
+	blob, err := EncodeControlKeyBlob(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(blob, "RSA1024:") {
+		t.Fatalf("wrong key blob prefix: %s", blob)
+	}
+	key, err := DecodeControlKeyBlob(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.(*rsa.PrivateKey).D.Cmp(sk.D) != 0 {
+		t.Fatal("RSA key doesn't round-trip")
+	}
+
+	edKey := ed25519.NewKeyFromSeed(testBytes(0, 32))
+	blob, err = EncodeControlKeyBlob(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(blob, "ED25519-V3:") {
+		t.Fatalf("wrong key blob prefix: %s", blob)
+	}
+	key, err = DecodeControlKeyBlob(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(key, ExpandEd25519PrivateKey(edKey)) {
+		t.Fatal("Ed25519 key doesn't round-trip")
+	}
+	expandedBlob, err := EncodeControlKeyBlob(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expandedBlob != blob {
+		t.Fatal("expanded Ed25519 key encodes differently")
+	}
+
+	if _, err := EncodeControlKeyBlob(&sk.PublicKey); err == nil {
+		t.Fatal("no error for unsupported key type")
+	}
+}
+
+func TestEncodeHSPOST(t *testing.T) {
+	desc := []byte("rendezvous-service-descriptor abc\n.dotted\n..twice\nlast")
+	fingerprint := strings.Repeat("AB", IdentityLength)
+	address := "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd"
+	cmd, err := EncodeHSPOST(desc, HSPOSTOptions{
+		Servers:   []string{"$" + fingerprint, "$" + fingerprint + "~relay"},
+		HSAddress: address + ".onion",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "+HSPOST SERVER=$" + fingerprint +
+		" SERVER=$" + fingerprint + "~relay" +
+		" HSADDRESS=" + address + "\r\n" +
+		"rendezvous-service-descriptor abc\r\n" +
+		"..dotted\r\n" +
+		"...twice\r\n" +
+		"last\r\n" +
+		".\r\n"
+	if cmd != expected {
+		t.Errorf("expected %q, got %q", expected, cmd)
+	}
+
+	cmd, err = EncodeHSPOST([]byte("a\r\nb\r\n"), HSPOSTOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd != "+HSPOST\r\na\r\nb\r\n.\r\n" {
+		t.Errorf("unexpected command %q", cmd)
+	}
+
+	for _, opts := range []HSPOSTOptions{
+		{Servers: []string{fingerprint}},
+		{Servers: []string{"$" + fingerprint[2:]}},
+		{Servers: []string{"$" + fingerprint + "~"}},
+		{Servers: []string{"$" + fingerprint + " PURPOSE=x"}},
+		{HSAddress: "hartwellnogoegst"},
+	} {
+		if _, err := EncodeHSPOST(desc, opts); err == nil {
+			t.Errorf("%+v is accepted", opts)
+		}
+	}
+	if _, err := EncodeHSPOST(nil, HSPOSTOptions{}); err == nil {
+		t.Errorf("empty descriptor is accepted")
+	}
+}
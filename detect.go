@@ -0,0 +1,137 @@
+// detect.go - detect types of onion service related documents.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nogoegst/onionutil/torparse"
+)
+
+// DocType is a type of onion service related document.
+type DocType int
+
+const (
+	DocTypeUnknown DocType = iota
+	// DocTypeDescriptor is a v2 onion service descriptor.
+	DocTypeDescriptor
+	// DocTypeIntroPoints is a plaintext introduction points document.
+	DocTypeIntroPoints
+	// DocTypeKey is a PEM-encoded key.
+	DocTypeKey
+)
+
+func (dt DocType) String() string {
+	switch dt {
+	case DocTypeUnknown:
+		return "unknown"
+	case DocTypeDescriptor:
+		return "descriptor"
+	case DocTypeIntroPoints:
+		return "introduction points"
+	case DocTypeKey:
+		return "key"
+	default:
+		return fmt.Sprintf("DocType(%d)", int(dt))
+	}
+}
+
+// ErrUnknownDocType is returned for data of unrecognized type.
+var ErrUnknownDocType = errors.New("unknown document type")
+
+// DetectDocumentType detects type of document in data by its leading
+// keyword (annotations are skipped) or PEM header. It returns
+// ErrUnknownDocType for anything else.
+func DetectDocumentType(data []byte) (DocType, error) {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if bytes.HasPrefix(data, []byte("-----BEGIN ")) {
+		block, _ := pem.Decode(data)
+		if block != nil && strings.HasSuffix(block.Type, "KEY") {
+			return DocTypeKey, nil
+		}
+		return DocTypeUnknown, ErrUnknownDocType
+	}
+	if torparse.CheckDocument(data) != nil {
+		return DocTypeUnknown, ErrUnknownDocType
+	}
+	for {
+		nl := bytes.IndexByte(data, '\n')
+		if nl < 0 {
+			return DocTypeUnknown, ErrUnknownDocType
+		}
+		line := data[:nl]
+		data = data[nl+1:]
+		keyword := string(bytes.SplitN(line, []byte(" "), 2)[0])
+		if keyword == "" || torparse.IsAnnotation(keyword) {
+			continue
+		}
+		switch keyword {
+		case "rendezvous-service-descriptor":
+			return DocTypeDescriptor, nil
+		case "introduction-point":
+			return DocTypeIntroPoints, nil
+		default:
+			return DocTypeUnknown, ErrUnknownDocType
+		}
+	}
+}
+
+// PeekDescriptorVersion returns version of onion service descriptor
+// in s without parsing it: it reads "hs-descriptor" line of v3
+// descriptors or "version" line following "rendezvous-service-descriptor"
+// of v2 ones. Leading annotations are skipped. It returns
+// ErrUnknownDocType if s doesn't start with a descriptor.
+func PeekDescriptorVersion(s string) (int, error) {
+	lines := strings.Split(s, "\n")
+	first := ""
+	for len(lines) > 0 {
+		line := strings.TrimRight(lines[0], "\r")
+		lines = lines[1:]
+		keyword := strings.SplitN(line, " ", 2)[0]
+		if keyword == "" || torparse.IsAnnotation(keyword) {
+			continue
+		}
+		first = line
+		break
+	}
+	keyword, version := first, ""
+	if i := strings.IndexByte(first, ' '); i >= 0 {
+		keyword, version = first[:i], first[i+1:]
+	}
+	switch keyword {
+	case "hs-descriptor":
+	case "rendezvous-service-descriptor":
+		version = ""
+		for _, line := range lines {
+			line = strings.TrimRight(line, "\r")
+			if strings.HasPrefix(line, "version ") {
+				version = line[len("version "):]
+				break
+			}
+			if line == "rendezvous-service-descriptor" ||
+				strings.HasPrefix(line, "rendezvous-service-descriptor ") {
+				break
+			}
+		}
+		if version == "" {
+			return 0, errors.New("descriptor has no version")
+		}
+	default:
+		return 0, ErrUnknownDocType
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(version))
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid descriptor version %q", version)
+	}
+	return v, nil
+}
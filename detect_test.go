@@ -0,0 +1,83 @@
+package onionutil
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDetectDocumentType(t *testing.T) {
+	key, err := ioutil.ReadFile("test/private_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := EncodeKeyBlock(&testPrivateKey(t).PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := testDescriptor(t).Bytes()
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		docType DocType
+	}{
+		{"descriptor", desc, DocTypeDescriptor},
+		{"annotated descriptor", append([]byte("@source test\n\n"), desc...), DocTypeDescriptor},
+		{"introduction points", MakeIntroPointsDocument(testIntroPoints(t, 2)), DocTypeIntroPoints},
+		{"private key", key, DocTypeKey},
+		{"public key", append([]byte("\n"), pubKey...), DocTypeKey},
+		{"server descriptor", []byte("router a 10.0.0.1 9001 0 0\n"), DocTypeUnknown},
+		{"signature", []byte("-----BEGIN SIGNATURE-----\nAAEC\n-----END SIGNATURE-----\n"), DocTypeUnknown},
+		{"garbage", testBytes(0, 64), DocTypeUnknown},
+		{"empty", nil, DocTypeUnknown},
+	} {
+		docType, err := DetectDocumentType(tc.data)
+		if docType != tc.docType {
+			t.Errorf("%s: detected %v", tc.name, docType)
+		}
+		if (docType == DocTypeUnknown) != (err == ErrUnknownDocType) {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+	}
+}
+
+func TestPeekDescriptorVersion(t *testing.T) {
+	v2 := string(testDescriptor(t).Bytes())
+	v3, _ := testDescriptorV3(t)
+	for _, tc := range []struct {
+		name    string
+		data    string
+		version int
+	}{
+		{"v2", v2, 2},
+		{"annotated v2", "@source test\n\n" + v2, 2},
+		{"v2 with CRLF", strings.Replace(v2, "\n", "\r\n", -1), 2},
+		{"v3", string(v3), 3},
+		{"future", "hs-descriptor 4\n", 4},
+	} {
+		version, err := PeekDescriptorVersion(tc.data)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if version != tc.version {
+			t.Errorf("%s: expected version %d, got %d", tc.name, tc.version, version)
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"router a 10.0.0.1 9001 0 0\n",
+		"hs-descriptor\n",
+		"hs-descriptor three\n",
+		"rendezvous-service-descriptor aaaa\npermanent-key\n",
+		"rendezvous-service-descriptor aaaa\nrendezvous-service-descriptor bbbb\nversion 2\n",
+	} {
+		if _, err := PeekDescriptorVersion(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+	if _, err := PeekDescriptorVersion("router a\n"); err != ErrUnknownDocType {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+// edwards.go - minimal edwards25519 arithmetic for key blinding
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"errors"
+	"math/big"
+)
+
+// The arithmetic here is variable-time and is meant for public keys only.
+
+var (
+	edP = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	edD = new(big.Int).Mod(new(big.Int).Mul(big.NewInt(-121665),
+		new(big.Int).ModInverse(big.NewInt(121666), edP)), edP)
+	// edSqrtM1 is a square root of -1 modulo edP.
+	edSqrtM1 = new(big.Int).Exp(big.NewInt(2),
+		new(big.Int).Rsh(new(big.Int).Sub(edP, big.NewInt(1)), 2), edP)
+
+	edBase = edPoint{
+		x: bigFromString("15112221349535400772501151409588531511454012693041857206046113283949847762202"),
+		y: bigFromString("46316835694926478169428394003475163141307993866256225615783033603165251855960"),
+	}
+)
+
+var errInvalidPoint = errors.New("invalid edwards25519 point")
+
+func bigFromString(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic("invalid number " + s)
+	}
+	return n
+}
+
+// edPoint is a point of edwards25519 in affine coordinates.
+type edPoint struct {
+	x, y *big.Int
+}
+
+func edIdentity() edPoint {
+	return edPoint{x: big.NewInt(0), y: big.NewInt(1)}
+}
+
+func (p edPoint) add(q edPoint) edPoint {
+	x1x2 := new(big.Int).Mul(p.x, q.x)
+	y1y2 := new(big.Int).Mul(p.y, q.y)
+	dxy := new(big.Int).Mul(edD, x1x2)
+	dxy.Mul(dxy, y1y2).Mod(dxy, edP)
+
+	xn := new(big.Int).Mul(p.x, q.y)
+	xn.Add(xn, new(big.Int).Mul(p.y, q.x))
+	xd := new(big.Int).Add(big.NewInt(1), dxy)
+	xd.ModInverse(xd, edP)
+
+	yn := new(big.Int).Add(y1y2, x1x2)
+	yd := new(big.Int).Sub(big.NewInt(1), dxy)
+	yd.Mod(yd, edP).ModInverse(yd, edP)
+
+	x := xn.Mul(xn, xd)
+	y := yn.Mul(yn, yd)
+	return edPoint{x: x.Mod(x, edP), y: y.Mod(y, edP)}
+}
+
+func (p edPoint) scalarMult(k *big.Int) edPoint {
+	r := edIdentity()
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		r = r.add(r)
+		if k.Bit(i) == 1 {
+			r = r.add(p)
+		}
+	}
+	return r
+}
+
+// edDecodePoint decodes a point from its 32-byte encoding.
+func edDecodePoint(b []byte) (edPoint, error) {
+	if len(b) != 32 {
+		return edPoint{}, errInvalidPoint
+	}
+	le := make([]byte, 32)
+	copy(le, b)
+	sign := uint(le[31] >> 7)
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reverseBytes(le))
+	if y.Cmp(edP) >= 0 {
+		return edPoint{}, errInvalidPoint
+	}
+	// x^2 = (y^2 - 1) / (d*y^2 + 1)
+	y2 := new(big.Int).Mul(y, y)
+	u := new(big.Int).Sub(y2, big.NewInt(1))
+	v := new(big.Int).Mul(edD, y2)
+	v.Add(v, big.NewInt(1)).ModInverse(v, edP)
+	x2 := u.Mul(u, v).Mod(u, edP)
+
+	exp := new(big.Int).Rsh(new(big.Int).Add(edP, big.NewInt(3)), 3)
+	x := new(big.Int).Exp(x2, exp, edP)
+	if new(big.Int).Exp(x, big.NewInt(2), edP).Cmp(x2) != 0 {
+		x.Mul(x, edSqrtM1).Mod(x, edP)
+		if new(big.Int).Exp(x, big.NewInt(2), edP).Cmp(x2) != 0 {
+			return edPoint{}, errInvalidPoint
+		}
+	}
+	if x.Sign() == 0 && sign == 1 {
+		return edPoint{}, errInvalidPoint
+	}
+	if x.Bit(0) != sign {
+		x.Sub(edP, x)
+	}
+	return edPoint{x: x, y: y}, nil
+}
+
+// bytes returns the 32-byte encoding of p.
+func (p edPoint) bytes() []byte {
+	b := make([]byte, 32)
+	yb := p.y.Bytes()
+	copy(b[32-len(yb):], yb)
+	b = reverseBytes(b)
+	b[31] |= byte(p.x.Bit(0)) << 7
+	return b
+}
+
+// edScalar interprets little-endian b as an integer.
+func edScalar(b []byte) *big.Int {
+	return new(big.Int).SetBytes(reverseBytes(append([]byte(nil), b...)))
+}
+
+func reverseBytes(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
@@ -1,3 +1,5 @@
 module github.com/nogoegst/onionutil
 
+go 1.13
+
 require golang.org/x/crypto v0.0.0-20181106171534-e4dc69e5b2fd
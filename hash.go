@@ -0,0 +1,44 @@
+// hash.go - hash functions named by their purpose
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+// Every v2 construction uses HashType (see Hash), but for different
+// purposes. Package code calls the wrappers below instead of Hash so that
+// each use names what it computes and an algorithm can be changed in one
+// place.
+
+// keyDigest returns digest of DER-encoded RSA public key der. It is
+// the relay identity digest and its prefix is the permanent id.
+func keyDigest(der []byte) []byte {
+	return Hash(der)
+}
+
+// documentDigest returns digest of document body the signature is made
+// over (descriptors and introduction points).
+func documentDigest(body []byte) []byte {
+	return Hash(body)
+}
+
+// descriptorIDHash returns H(parts...) as used for secret id parts and
+// descriptor ids.
+func descriptorIDHash(parts ...[]byte) []byte {
+	h := HashType.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// clientIDHash returns H(cookie | iv) client ids of basic client
+// authorization are derived from.
+func clientIDHash(cookie, iv []byte) []byte {
+	h := HashType.New()
+	h.Write(cookie)
+	h.Write(iv)
+	return h.Sum(nil)
+}
@@ -0,0 +1,23 @@
+package onionutil
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestPurposeHashes(t *testing.T) {
+	const abc = "a9993e364706816aba3e25717850c26c9cd0d89d" // SHA1("abc")
+	for name, digest := range map[string][]byte{
+		"key":           keyDigest([]byte("abc")),
+		"document":      documentDigest([]byte("abc")),
+		"descriptor id": descriptorIDHash([]byte("a"), []byte("bc")),
+		"client id":     clientIDHash([]byte("ab"), []byte("c")),
+	} {
+		if hex.EncodeToString(digest) != abc {
+			t.Errorf("%s: wrong digest %x", name, digest)
+		}
+	}
+	if hex.EncodeToString(descriptorIDHash()) != "da39a3ee5e6b4b0d3255bfef95601890afd80709" {
+		t.Error("wrong digest of empty input")
+	}
+}
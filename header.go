@@ -0,0 +1,95 @@
+// header.go - quick parsing of onion service descriptor headers.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"crypto/rsa"
+	"strconv"
+	"time"
+
+	"github.com/nogoegst/onionutil/torparse"
+)
+
+// DescHeader holds the leading fields of a descriptor.
+type DescHeader struct {
+	DescID          DescriptorID
+	Version         int
+	PermanentKey    *rsa.PublicKey
+	PublicationTime time.Time
+}
+
+// ParseDescriptorHeader parses only the leading fields of the descriptor
+// in s, stopping as soon as they are read. It doesn't touch introduction
+// points and signature, so it is much cheaper than full parsing but
+// doesn't validate the descriptor. Use it to index descriptors. If s
+// doesn't start with a descriptor, ErrNotOnionDescriptor is returned.
+func ParseDescriptorHeader(s string) (DescHeader, error) {
+	var h DescHeader
+	data := []byte(s)
+	var haveID, haveVersion, haveTime bool
+	first := true
+	for !haveID || !haveVersion || h.PermanentKey == nil || !haveTime {
+		field, content, rest, err := torparse.ParseOutNextField(data)
+		if err != nil {
+			break
+		}
+		data = rest
+		if field == "" || torparse.IsAnnotation(field) {
+			continue
+		}
+		if first {
+			if field != "rendezvous-service-descriptor" {
+				return h, ErrNotOnionDescriptor
+			}
+			first = false
+		} else if field == "rendezvous-service-descriptor" ||
+			field == "introduction-points" || field == "signature" {
+			break /* Past the header */
+		}
+		value := content.Joined()
+		switch field {
+		case "rendezvous-service-descriptor":
+			h.DescID, err = ParseDescriptorID(string(value))
+			if err != nil {
+				return h, &FieldError{field, err}
+			}
+			haveID = true
+		case "version":
+			version, err := strconv.Atoi(string(value))
+			if err != nil {
+				return h, &FieldError{field, err}
+			}
+			if version != DescVersion {
+				return h, ErrUnsupportedVersion{version}
+			}
+			h.Version, haveVersion = version, true
+		case "permanent-key":
+			h.PermanentKey, err = decodePublicKey(value)
+			if err != nil {
+				return h, &FieldError{field, err}
+			}
+		case "publication-time":
+			t, err := time.Parse(PublicationTimeFormat, string(value))
+			if err != nil {
+				return h, &FieldError{field, err}
+			}
+			h.PublicationTime, haveTime = NormalizePublicationTime(t), true
+		}
+	}
+	switch {
+	case first:
+		return h, ErrNotOnionDescriptor
+	case !haveVersion:
+		return h, ErrMissingField{"version"}
+	case h.PermanentKey == nil:
+		return h, ErrMissingField{"permanent-key"}
+	case !haveTime:
+		return h, ErrMissingField{"publication-time"}
+	}
+	return h, nil
+}
@@ -0,0 +1,60 @@
+package onionutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDescriptorHeader(t *testing.T) {
+	desc := testDescriptor(t)
+	body := string(desc.Bytes())
+	h, err := ParseDescriptorHeader("@source test\n" + body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.DescID != desc.DescID || h.Version != desc.Version ||
+		h.PermanentKey.N.Cmp(desc.PermanentKey.N) != 0 ||
+		!h.PublicationTime.Equal(desc.PublicationTime) {
+		t.Errorf("wrong header %+v", h)
+	}
+
+	// Header is parsed without looking at the rest of the descriptor.
+	truncated := body[:strings.Index(body, "protocol-versions")]
+	if _, err := ParseDescriptorHeader(truncated + "signature\ngarbage"); err != nil {
+		t.Errorf("header of truncated descriptor is not parsed: %v", err)
+	}
+
+	if _, err := ParseDescriptorHeader("router a\n" + body); err != ErrNotOnionDescriptor {
+		t.Errorf("unexpected error for foreign document: %v", err)
+	}
+	noTime := string(removeField([]byte(body), "publication-time"))
+	if _, err := ParseDescriptorHeader(noTime); err != (ErrMissingField{"publication-time"}) {
+		t.Errorf("unexpected error for missing field: %v", err)
+	}
+	badVersion := strings.Replace(body, "version 2\n", "version 3\n", 1)
+	if _, err := ParseDescriptorHeader(badVersion); err != (ErrUnsupportedVersion{3}) {
+		t.Errorf("unexpected error for unsupported version: %v", err)
+	}
+}
+
+func BenchmarkParseDescriptorHeader(b *testing.B) {
+	corpus := string(testCorpus(b, 1))
+	b.SetBytes(int64(len(corpus)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseDescriptorHeader(corpus); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseDescriptorFull(b *testing.B) {
+	corpus := testCorpus(b, 1)
+	b.SetBytes(int64(len(corpus)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := new(Parser).ParseOnionDescriptors(corpus); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
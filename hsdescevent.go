@@ -0,0 +1,152 @@
+// hsdescevent.go - decode HS_DESC control port events
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Actions of HS_DESC events.
+const (
+	HSDescRequested = "REQUESTED"
+	HSDescUpload    = "UPLOAD"
+	HSDescReceived  = "RECEIVED"
+	HSDescUploaded  = "UPLOADED"
+	HSDescIgnore    = "IGNORE"
+	HSDescFailed    = "FAILED"
+	HSDescCreated   = "CREATED"
+)
+
+// HSDescUnknown is used by tor in place of unknown address, auth type
+// or HSDir in HS_DESC events.
+const HSDescUnknown = "UNKNOWN"
+
+const (
+	hsDescEventKeyword        = "HS_DESC"
+	hsDescContentEventKeyword = "HS_DESC_CONTENT"
+)
+
+// HSDescEvent is an HS_DESC event tor emits on descriptor fetches
+// and uploads.
+type HSDescEvent struct {
+	Action string
+	// Address is the onion address without ".onion" suffix.
+	Address  string
+	AuthType string
+	// HSDir is the directory as LongName or fingerprint.
+	HSDir string
+	// DescID is the descriptor id as sent by tor (base32 for v2,
+	// base64 for v3). It is empty if the event doesn't carry one.
+	DescID string
+	// Reason is set for FAILED events.
+	Reason string
+	// Params holds other keyword arguments, e.g. REPLICA.
+	Params map[string]string
+}
+
+// ParseHSDescEvent parses line of HS_DESC event with or without leading
+// "650 " status code.
+func ParseHSDescEvent(line string) (*HSDescEvent, error) {
+	fields := strings.Fields(trimEventStatus(line))
+	if len(fields) == 0 || fields[0] != hsDescEventKeyword {
+		return nil, errors.New("not an HS_DESC event")
+	}
+	fields = fields[1:]
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("HS_DESC event has too few arguments: %d", len(fields))
+	}
+	ev := &HSDescEvent{
+		Action:   fields[0],
+		Address:  fields[1],
+		AuthType: fields[2],
+		HSDir:    fields[3],
+	}
+	fields = fields[4:]
+	if len(fields) > 0 && !strings.Contains(fields[0], "=") {
+		ev.DescID = fields[0]
+		fields = fields[1:]
+	}
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("unexpected HS_DESC argument %q", field)
+		}
+		if kv[0] == "REASON" {
+			ev.Reason = kv[1]
+			continue
+		}
+		if ev.Params == nil {
+			ev.Params = make(map[string]string)
+		}
+		ev.Params[kv[0]] = kv[1]
+	}
+	return ev, nil
+}
+
+// HSDescContentEvent is an HS_DESC_CONTENT event that carries
+// a fetched descriptor.
+type HSDescContentEvent struct {
+	Address string
+	DescID  string
+	HSDir   string
+	// Descriptor is the unescaped descriptor with "\n" line endings
+	// ready for ParseOnionDescriptors. It is empty if tor failed
+	// to fetch the descriptor.
+	Descriptor []byte
+}
+
+// ParseHSDescContentEvent parses multiline HS_DESC_CONTENT event data:
+// "650+HS_DESC_CONTENT" line followed by dot-escaped descriptor, a line
+// with single "." and, optionally, "650 OK".
+func ParseHSDescContentEvent(data []byte) (*HSDescContentEvent, error) {
+	lines := strings.Split(string(data), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	fields := strings.Fields(trimEventStatus(lines[0]))
+	if len(fields) == 0 || fields[0] != hsDescContentEventKeyword {
+		return nil, errors.New("not an HS_DESC_CONTENT event")
+	}
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("HS_DESC_CONTENT event has %d arguments instead of 3", len(fields)-1)
+	}
+	ev := &HSDescContentEvent{
+		Address: fields[1],
+		DescID:  fields[2],
+		HSDir:   fields[3],
+	}
+	var desc bytes.Buffer
+	lines = lines[1:]
+	for i, line := range lines {
+		if line == "." {
+			for _, line := range lines[i+1:] {
+				if line != "" && trimEventStatus(line) != "OK" {
+					return nil, fmt.Errorf("unexpected data after HS_DESC_CONTENT: %q", line)
+				}
+			}
+			ev.Descriptor = desc.Bytes()
+			return ev, nil
+		}
+		desc.WriteString(strings.TrimPrefix(line, "."))
+		desc.WriteByte('\n')
+	}
+	return nil, errors.New("unterminated HS_DESC_CONTENT event")
+}
+
+// trimEventStatus strips line ending and "650" status code followed
+// by " ", "-" or "+" from the event line.
+func trimEventStatus(line string) string {
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) >= 4 && strings.HasPrefix(line, "650") && strings.ContainsRune(" -+", rune(line[3])) {
+		line = line[4:]
+	}
+	return line
+}
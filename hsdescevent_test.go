@@ -0,0 +1,116 @@
+package onionutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHSDescEvent(t *testing.T) {
+	for _, tc := range []struct {
+		line     string
+		expected HSDescEvent
+	}{
+		{
+			"650 HS_DESC REQUESTED facebookcorewwwi NO_AUTH $F3CA7AA5A16D3B4A8F0B9BF2D2C2DC6D1A7E9F25~relay b3oeducbhjmbqmgw2i3jtz4fekkrinwj\r\n",
+			HSDescEvent{
+				Action:   HSDescRequested,
+				Address:  "facebookcorewwwi",
+				AuthType: "NO_AUTH",
+				HSDir:    "$F3CA7AA5A16D3B4A8F0B9BF2D2C2DC6D1A7E9F25~relay",
+				DescID:   "b3oeducbhjmbqmgw2i3jtz4fekkrinwj",
+			},
+		},
+		{
+			"HS_DESC FAILED facebookcorewwwi NO_AUTH $F3CA7AA5A16D3B4A8F0B9BF2D2C2DC6D1A7E9F25 b3oeducbhjmbqmgw2i3jtz4fekkrinwj REASON=NOT_FOUND REPLICA=1",
+			HSDescEvent{
+				Action:   HSDescFailed,
+				Address:  "facebookcorewwwi",
+				AuthType: "NO_AUTH",
+				HSDir:    "$F3CA7AA5A16D3B4A8F0B9BF2D2C2DC6D1A7E9F25",
+				DescID:   "b3oeducbhjmbqmgw2i3jtz4fekkrinwj",
+				Reason:   "NOT_FOUND",
+				Params:   map[string]string{"REPLICA": "1"},
+			},
+		},
+		{
+			"650 HS_DESC FAILED facebookcorewwwi NO_AUTH UNKNOWN REASON=QUERY_NO_HSDIR",
+			HSDescEvent{
+				Action:   HSDescFailed,
+				Address:  "facebookcorewwwi",
+				AuthType: "NO_AUTH",
+				HSDir:    HSDescUnknown,
+				Reason:   "QUERY_NO_HSDIR",
+			},
+		},
+	} {
+		ev, err := ParseHSDescEvent(tc.line)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.line, err)
+		}
+		if !reflect.DeepEqual(*ev, tc.expected) {
+			t.Errorf("%q: expected %+v, got %+v", tc.line, tc.expected, *ev)
+		}
+	}
+
+	for _, line := range []string{
+		"",
+		"650 CIRC 1 BUILT",
+		"650 HS_DESC REQUESTED facebookcorewwwi NO_AUTH",
+		"650 HS_DESC FAILED facebookcorewwwi NO_AUTH UNKNOWN descid garbage",
+	} {
+		if _, err := ParseHSDescEvent(line); err == nil {
+			t.Errorf("%q is parsed", line)
+		}
+	}
+}
+
+func TestParseHSDescContentEvent(t *testing.T) {
+	descData, err := ioutil.ReadFile("test/service-descriptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	post, err := EncodeHSPOST(descData, HSPOSTOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := "650+HS_DESC_CONTENT facebookcorewwwi b3oeducbhjmbqmgw2i3jtz4fekkrinwj $F3CA7AA5A16D3B4A8F0B9BF2D2C2DC6D1A7E9F25\r\n"
+	data := header + post[strings.Index(post, "\r\n")+2:] + "650 OK\r\n"
+	ev, err := ParseHSDescContentEvent([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Address != "facebookcorewwwi" ||
+		ev.DescID != "b3oeducbhjmbqmgw2i3jtz4fekkrinwj" ||
+		ev.HSDir != "$F3CA7AA5A16D3B4A8F0B9BF2D2C2DC6D1A7E9F25" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	if !bytes.Equal(bytes.TrimSpace(ev.Descriptor), bytes.TrimSpace(descData)) {
+		t.Errorf("descriptor is not reassembled")
+	}
+	descs, _ := ParseOnionDescriptors(ev.Descriptor)
+	if len(descs) != 1 {
+		t.Errorf("parsed %d descriptors instead of 1", len(descs))
+	}
+
+	ev, err = ParseHSDescContentEvent([]byte("650+HS_DESC_CONTENT a b c\n..dot\n.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ev.Descriptor) != ".dot\n" {
+		t.Errorf("unexpected descriptor %q", ev.Descriptor)
+	}
+
+	for _, data := range []string{
+		"650 HS_DESC REQUESTED a b c d",
+		"650+HS_DESC_CONTENT a b\r\n.\r\n",
+		"650+HS_DESC_CONTENT a b c\r\nfoo\r\n",
+		"650+HS_DESC_CONTENT a b c\r\n.\r\ngarbage\r\n",
+	} {
+		if _, err := ParseHSDescContentEvent([]byte(data)); err == nil {
+			t.Errorf("%q is parsed", data)
+		}
+	}
+}
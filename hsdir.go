@@ -0,0 +1,235 @@
+// hsdir.go - talk to onion service directories
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+)
+
+// Dialer is a means to establish connections. It is satisfied by
+// golang.org/x/net/proxy.Dialer, e.g. a SOCKS5 dialer of a Tor client.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// DescriptorPublishPath is HTTP path on a directory server to
+// upload descriptors to.
+const DescriptorPublishPath = "/tor/rendezvous2/publish"
+
+// DescriptorPathPrefix is the prefix of HTTP paths of v2 descriptors
+// on a directory server.
+const DescriptorPathPrefix = "/tor/rendezvous2/"
+
+// DescriptorPath returns HTTP path of a v2 descriptor with id descID
+// on a directory server.
+func DescriptorPath(descID DescriptorID) string {
+	return DescriptorPathPrefix + descID.String()
+}
+
+// contextDialer is implemented by dialers that can be cancelled, like
+// net.Dialer or golang.org/x/net/proxy.ContextDialer.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func hsdirClient(dialer Dialer) *http.Client {
+	transport := &http.Transport{Dial: dialer.Dial}
+	if d, ok := dialer.(contextDialer); ok {
+		transport.DialContext = d.DialContext
+	}
+	return &http.Client{Transport: transport}
+}
+
+// FetchDescriptor fetches descriptor with id descID from the directory
+// server hsdir (host:port of its DirPort) using dialer.
+func FetchDescriptor(dialer Dialer, hsdir string, descID DescriptorID) (*OnionDescriptor, error) {
+	return fetchDescriptor(context.Background(), hsdirClient(dialer), hsdir, descID)
+}
+
+func fetchDescriptor(ctx context.Context, client *http.Client, hsdir string, descID DescriptorID) (*OnionDescriptor, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+hsdir+DescriptorPath(descID), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch descriptor: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxDescriptorSize+1))
+	if err != nil {
+		return nil, err
+	}
+	descs, _, err := new(Parser).ParseOnionDescriptors(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(descs) == 0 {
+		return nil, errors.New("no valid descriptors in response")
+	}
+	desc := &descs[0]
+	if desc.DescID != descID {
+		return nil, errors.New("fetched descriptor has wrong id")
+	}
+	return desc, nil
+}
+
+// DefaultFetchTimeout is the default time limit of a single fetch attempt.
+const DefaultFetchTimeout = 30 * time.Second
+
+// FetchOptions holds options of FetchDescriptorWithRetry. The zero value
+// is ready to use.
+type FetchOptions struct {
+	// Timeout limits each attempt. Zero means DefaultFetchTimeout.
+	Timeout time.Duration
+	// Attempts is the number of attempts made with each directory
+	// server. Zero means one.
+	Attempts int
+}
+
+// FetchError holds errors of all failed fetch attempts.
+type FetchError struct {
+	Errors []error
+}
+
+func (e *FetchError) Error() string {
+	var msgs []string
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("all %d fetch attempts failed: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// FetchDescriptorWithRetry fetches descriptor with id descID trying
+// directory servers hsdirs (host:port of their DirPorts, usually the
+// responsible ones) in order using dialer. It returns the first descriptor
+// that passes Verify, i.e. with valid signature over the received bytes
+// and id matching its permanent key. If all attempts fail, a *FetchError
+// is returned. It stops once ctx is done.
+func FetchDescriptorWithRetry(ctx context.Context, dialer Dialer, descID DescriptorID, hsdirs []string, opts FetchOptions) (*OnionDescriptor, error) {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultFetchTimeout
+	}
+	attempts := opts.Attempts
+	if attempts == 0 {
+		attempts = 1
+	}
+	client := hsdirClient(dialer)
+	ferr := new(FetchError)
+	for attempt := 0; attempt < attempts; attempt++ {
+		for _, hsdir := range hsdirs {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+			desc, err := fetchDescriptor(attemptCtx, client, hsdir, descID)
+			cancel()
+			if err == nil {
+				err = desc.Verify()
+			}
+			if err == nil {
+				return desc, nil
+			}
+			ferr.Errors = append(ferr.Errors, fmt.Errorf("%s: %v", hsdir, err))
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(ferr.Errors) == 0 {
+		return nil, errors.New("no directory servers to fetch from")
+	}
+	return nil, ferr
+}
+
+// EncodeUploadRequest encodes an HTTP request that uploads descriptor
+// descBytes to the directory server hsdir.
+func EncodeUploadRequest(hsdir string, descBytes []byte) []byte {
+	w := new(bytes.Buffer)
+	fmt.Fprintf(w, "POST %s HTTP/1.0\r\n", DescriptorPublishPath)
+	fmt.Fprintf(w, "Host: %s\r\n", hsdir)
+	fmt.Fprintf(w, "Content-Length: %d\r\n", len(descBytes))
+	fmt.Fprintf(w, "\r\n")
+	w.Write(descBytes)
+	return w.Bytes()
+}
+
+// PublishDescriptor uploads signed descriptor descBytes to the directory
+// server hsdir (host:port of its DirPort) using dialer.
+func PublishDescriptor(dialer Dialer, hsdir string, descBytes []byte) error {
+	conn, err := dialer.Dial("tcp", hsdir)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(EncodeUploadRequest(hsdir, descBytes)); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to publish descriptor: %s", resp.Status)
+	}
+	return nil
+}
+
+// DirResponseBody frames signed descriptor desc the way a directory server
+// serves it: HTTP/1.0 response headers followed by the descriptor.
+func DirResponseBody(desc *OnionDescriptor) ([]byte, error) {
+	body, err := desc.Body()
+	if err != nil {
+		return nil, err
+	}
+	w := new(bytes.Buffer)
+	fmt.Fprintf(w, "HTTP/1.0 200 OK\r\n")
+	fmt.Fprintf(w, "Content-Type: text/plain\r\n")
+	fmt.Fprintf(w, "Content-Encoding: identity\r\n")
+	fmt.Fprintf(w, "Content-Length: %d\r\n", len(body))
+	fmt.Fprintf(w, "\r\n")
+	w.Write(body)
+	return w.Bytes(), nil
+}
+
+// StripDirResponse strips HTTP framing of directory server response resp
+// and returns its body. Chunked bodies are dechunked.
+func StripDirResponse(resp []byte) ([]byte, error) {
+	r, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("directory server responded with %s", r.Status)
+	}
+	return ioutil.ReadAll(r.Body)
+}
+
+// DechunkHTTPBody decodes body sent with "Transfer-Encoding: chunked",
+// for callers that read HTTP responses by hand, e.g. over a raw Tor
+// circuit. Trailers after the last chunk are ignored.
+func DechunkHTTPBody(body []byte) ([]byte, error) {
+	return ioutil.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body)))
+}
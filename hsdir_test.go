@@ -0,0 +1,284 @@
+package onionutil
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDialer connects to addr regardless of the requested address.
+type testDialer struct {
+	addr string
+}
+
+func (d testDialer) Dial(network, _ string) (net.Conn, error) {
+	return net.Dial(network, d.addr)
+}
+
+func TestFetchDescriptor(t *testing.T) {
+	desc, err := NewOnionDescriptor(&testPrivateKey(t).PublicKey, testIntroPoints(t, 3), 0, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := desc.Sign(testPrivateKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != DescriptorPath(desc.DescID) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(desc.Bytes())
+	}))
+	defer ts.Close()
+	dialer := testDialer{ts.Listener.Addr().String()}
+
+	fetched, err := FetchDescriptor(dialer, "hsdir.example:80", desc.DescID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !SameService(*fetched, *desc) {
+		t.Fatal("fetched descriptor of a wrong service")
+	}
+	if string(fetched.IntropointsBlock) != string(desc.IntropointsBlock) {
+		t.Fatal("introduction points mismatch")
+	}
+
+	if _, err := FetchDescriptor(dialer, "hsdir.example:80", DescriptorID{}); err == nil {
+		t.Fatal("no error for nonexistent descriptor")
+	}
+}
+
+func TestFetchDescriptorWithRetry(t *testing.T) {
+	sk := testPrivateKey(t)
+	desc, err := NewOnionDescriptor(&sk.PublicKey, testIntroPoints(t, 3), 0, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := desc.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	forged := *desc
+	forged.Signature = append([]byte{}, desc.Signature...)
+	forged.Signature[0] ^= 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "forged:80":
+			w.Write(forged.Bytes())
+		case "slow:80":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			w.Write(desc.Bytes())
+		case "good:80":
+			w.Write(desc.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	dialer := testDialer{ts.Listener.Addr().String()}
+	opts := FetchOptions{Timeout: 50 * time.Millisecond}
+	ctx := context.Background()
+
+	hsdirs := []string{"missing:80", "forged:80", "slow:80", "good:80"}
+	fetched, err := FetchDescriptorWithRetry(ctx, dialer, desc.DescID, hsdirs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched.Signature, desc.Signature) {
+		t.Fatal("forged descriptor is returned")
+	}
+
+	opts.Attempts = 2
+	_, err = FetchDescriptorWithRetry(ctx, dialer, desc.DescID, hsdirs[:3], opts)
+	ferr, ok := err.(*FetchError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ferr.Errors) != 6 {
+		t.Errorf("expected 6 errors, got %v", ferr.Errors)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := FetchDescriptorWithRetry(cancelled, dialer, desc.DescID, hsdirs, opts); err != context.Canceled {
+		t.Errorf("fetching doesn't stop on cancellation: %v", err)
+	}
+}
+
+// rewrapPEM rewraps base64 lines of the first PEM block of type
+// blockType in data to width columns.
+func rewrapPEM(t *testing.T, data []byte, blockType string, width int) []byte {
+	begin := []byte("-----BEGIN " + blockType + "-----\n")
+	i := bytes.Index(data, begin)
+	if i < 0 {
+		t.Fatalf("no %s block", blockType)
+	}
+	block, rest := pem.Decode(data[i:])
+	if block == nil {
+		t.Fatalf("malformed %s block", blockType)
+	}
+	w := bytes.NewBuffer(append([]byte{}, data[:i]...))
+	w.Write(begin)
+	encoded := base64.StdEncoding.EncodeToString(block.Bytes)
+	for len(encoded) > width {
+		w.WriteString(encoded[:width] + "\n")
+		encoded = encoded[width:]
+	}
+	w.WriteString(encoded + "\n")
+	w.WriteString("-----END " + blockType + "-----\n")
+	w.Write(rest)
+	return w.Bytes()
+}
+
+func TestFetchNonCanonicalDescriptor(t *testing.T) {
+	sk := testPrivateKey(t)
+	desc := testDescriptor(t)
+	/* Wrap the key as other encoders may do */
+	body := rewrapPEM(t, desc.BodyForSigning(), "RSA PUBLIC KEY", 76)
+	sig, err := sk.Sign(rand.Reader, Hash(body), crypto.Hash(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(body, pem.EncodeToMemory(&pem.Block{Type: "SIGNATURE", Bytes: sig})...)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer ts.Close()
+	dialer := testDialer{ts.Listener.Addr().String()}
+
+	fetched, err := FetchDescriptorWithRetry(context.Background(), dialer, desc.DescID, []string{"hsdir.example:80"}, FetchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fetched.VerifySignature(); err == nil {
+		t.Fatal("re-encoded descriptor matches the received one")
+	}
+	if !bytes.Equal(fetched.Raw, data) {
+		t.Error("received bytes are not preserved")
+	}
+	if _, ok := FreshestDescriptor([]OnionDescriptor{*fetched}); !ok {
+		t.Error("received descriptor is not considered valid")
+	}
+	for _, kv := range fetched.Fields() {
+		if kv.Key == "signature" && kv.Value != "valid" {
+			t.Errorf("signature of received descriptor is %s", kv.Value)
+		}
+	}
+}
+
+func TestPublishDescriptor(t *testing.T) {
+	desc, err := NewOnionDescriptor(&testPrivateKey(t).PublicKey, nil, 0, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := desc.Sign(testPrivateKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	var published []OnionDescriptor
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != DescriptorPublishPath {
+			http.NotFound(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		descs, _ := ParseOnionDescriptors(body)
+		if len(descs) == 0 {
+			http.Error(w, "Invalid descriptor", http.StatusBadRequest)
+			return
+		}
+		published = append(published, descs...)
+	}))
+	defer ts.Close()
+	dialer := testDialer{ts.Listener.Addr().String()}
+
+	if err := PublishDescriptor(dialer, "hsdir.example:80", desc.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 1 || !SameService(published[0], *desc) {
+		t.Fatal("descriptor is not published")
+	}
+	if err := PublishDescriptor(dialer, "hsdir.example:80", []byte("garbage\n")); err == nil {
+		t.Fatal("no error for rejected descriptor")
+	}
+}
+
+func TestDirResponseBody(t *testing.T) {
+	desc := testDescriptor(t)
+	resp, err := DirResponseBody(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(resp), "HTTP/1.0 200 OK\r\n") {
+		t.Fatalf("wrong status line: %q", resp)
+	}
+	body, err := StripDirResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != string(desc.Bytes()) {
+		t.Fatal("descriptor doesn't round-trip")
+	}
+	if _, err := StripDirResponse([]byte("HTTP/1.0 404 Not found\r\n\r\n")); err == nil {
+		t.Fatal("no error for unsuccessful response")
+	}
+}
+
+func TestDechunkHTTPBody(t *testing.T) {
+	desc := testDescriptor(t).Bytes()
+	var chunked bytes.Buffer
+	w := httputil.NewChunkedWriter(&chunked)
+	for rest := desc; len(rest) > 0; {
+		n := 100
+		if n > len(rest) {
+			n = len(rest)
+		}
+		w.Write(rest[:n])
+		rest = rest[n:]
+	}
+	w.Close()
+	chunked.WriteString("X-Trailer: ignored\r\n\r\n")
+
+	body, err := DechunkHTTPBody(chunked.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, desc) {
+		t.Fatal("dechunked body differs")
+	}
+	extended := "5;name=value\r\nhello\r\n0\r\n\r\n"
+	if body, err := DechunkHTTPBody([]byte(extended)); err != nil || string(body) != "hello" {
+		t.Errorf("chunk extensions are not handled: %q, %v", body, err)
+	}
+	for _, malformed := range []string{"zz\r\nhello\r\n0\r\n\r\n", "5\r\nhel", "5\r\nhelloXX0\r\n\r\n"} {
+		if _, err := DechunkHTTPBody([]byte(malformed)); err == nil {
+			t.Errorf("%q: no error", malformed)
+		}
+	}
+
+	resp := append([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"), chunked.Bytes()...)
+	body, err = StripDirResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, desc) {
+		t.Fatal("chunked response body differs")
+	}
+}
@@ -0,0 +1,115 @@
+// hsdirtest.go - mock onion service directory for tests
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+// Package hsdirtest provides a mock onion service directory to test
+// code that fetches and publishes descriptors without Tor network.
+package hsdirtest
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/nogoegst/onionutil"
+)
+
+// HSDir is a directory server that stores v2 onion service descriptors
+// at the standard paths.
+type HSDir struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	descs map[onionutil.DescriptorID][]byte
+}
+
+// NewHSDir starts and returns a new HSDir. The caller should call Close
+// when finished, to shut it down.
+func NewHSDir() *HSDir {
+	d := &HSDir{descs: make(map[onionutil.DescriptorID][]byte)}
+	d.Server = httptest.NewServer(d)
+	return d
+}
+
+// ServeHTTP serves descriptor fetches and uploads.
+func (d *HSDir) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "POST" && r.URL.Path == onionutil.DescriptorPublishPath:
+		d.servePublish(w, r)
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, onionutil.DescriptorPathPrefix):
+		id := strings.TrimPrefix(r.URL.Path, onionutil.DescriptorPathPrefix)
+		descID, err := onionutil.ParseDescriptorID(id)
+		if err != nil {
+			http.Error(w, "Invalid descriptor id", http.StatusBadRequest)
+			return
+		}
+		desc := d.Descriptor(descID)
+		if desc == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(desc)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (d *HSDir) servePublish(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, onionutil.MaxDescriptorSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > onionutil.MaxDescriptorSize {
+		http.Error(w, onionutil.ErrDescriptorTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	descs, _, err := new(onionutil.Parser).ParseOnionDescriptors(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(descs) == 0 {
+		http.Error(w, "Invalid descriptor", http.StatusBadRequest)
+		return
+	}
+	for _, desc := range descs {
+		if err := desc.Verify(); err != nil {
+			http.Error(w, "Invalid descriptor signature", http.StatusBadRequest)
+			return
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, desc := range descs {
+		/* Serve what was uploaded, not our re-encoding */
+		d.descs[desc.DescID] = desc.Raw
+	}
+}
+
+// Descriptor returns stored descriptor with id descID or nil if there
+// is no such descriptor.
+func (d *HSDir) Descriptor(descID onionutil.DescriptorID) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.descs[descID]
+}
+
+// Dialer returns a dialer that connects to d regardless of requested
+// address.
+func (d *HSDir) Dialer() onionutil.Dialer {
+	return dialer(d.Listener.Addr().String())
+}
+
+type dialer string
+
+func (addr dialer) Dial(network, _ string) (net.Conn, error) {
+	return net.Dial(network, string(addr))
+}
@@ -0,0 +1,62 @@
+package hsdirtest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/nogoegst/onionutil"
+)
+
+func TestHSDir(t *testing.T) {
+	sk, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := onionutil.NewOnionDescriptor(&sk.PublicKey, nil, 0, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hsdir := NewHSDir()
+	defer hsdir.Close()
+
+	if err := onionutil.PublishDescriptor(hsdir.Dialer(), "hsdir:80", desc.Bytes()); err == nil {
+		t.Fatal("unsigned descriptor is accepted")
+	}
+	if err := desc.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	if err := onionutil.PublishDescriptor(hsdir.Dialer(), "hsdir:80", desc.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if hsdir.Descriptor(desc.DescID) == nil {
+		t.Fatal("descriptor is not stored")
+	}
+	fetched, err := onionutil.FetchDescriptor(hsdir.Dialer(), "hsdir:80", desc.DescID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fetched.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Uploaded bytes our encoder can't reproduce are kept as is */
+	body := bytes.Replace(desc.BodyForSigning(), []byte("\nsignature\n"),
+		[]byte("\nnew-shiny-field x\nsignature\n"), 1)
+	sig, err := sk.Sign(rand.Reader, onionutil.Hash(body), crypto.Hash(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(body, pem.EncodeToMemory(&pem.Block{Type: "SIGNATURE", Bytes: sig})...)
+	if err := onionutil.PublishDescriptor(hsdir.Dialer(), "hsdir:80", data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hsdir.Descriptor(desc.DescID), data) {
+		t.Error("uploaded descriptor is not stored as is")
+	}
+}
@@ -0,0 +1,194 @@
+// introcrypt.go - client authorization encryption of introduction points
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	// introBlockIVLength is the length of AES-CTR IV preceding encrypted
+	// introduction points.
+	introBlockIVLength = aes.BlockSize
+	// basicAuthClientIDLength is the length of client id in a client
+	// entry of basic authorization.
+	basicAuthClientIDLength = 4
+	// basicAuthClientEntryLength is the length of a client entry: client
+	// id and encrypted session key.
+	basicAuthClientEntryLength = basicAuthClientIDLength + DescriptorCookieLength
+	// basicAuthClientMultiple is the granularity the number of client
+	// entries is padded to.
+	basicAuthClientMultiple = 16
+)
+
+// aesCTR applies AES-128-CTR keystream of key and iv to src.
+func aesCTR(key, iv, src []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, len(src))
+	cipher.NewCTR(block, iv).XORKeyStream(dst, src)
+	return dst, nil
+}
+
+// encryptIntroBlock encrypts plaintext with AES-128-CTR under key and iv
+// and returns iv followed by the ciphertext, as tor's
+// crypto_cipher_encrypt_with_iv does.
+func encryptIntroBlock(plaintext, key, iv []byte) ([]byte, error) {
+	if len(iv) != introBlockIVLength {
+		return nil, fmt.Errorf("invalid IV length %d", len(iv))
+	}
+	ciphertext, err := aesCTR(key, iv, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, iv...), ciphertext...), nil
+}
+
+// decryptIntroBlock decrypts block made by encryptIntroBlock with key.
+func decryptIntroBlock(block, key []byte) ([]byte, error) {
+	if len(block) < introBlockIVLength {
+		return nil, errors.New("encrypted block is too short")
+	}
+	return aesCTR(key, block[:introBlockIVLength], block[introBlockIVLength:])
+}
+
+// basicAuthClientID returns id of the client with cookie for the block
+// encrypted with iv.
+func basicAuthClientID(cookie, iv []byte) []byte {
+	return clientIDHash(cookie, iv)[:basicAuthClientIDLength]
+}
+
+// EncryptIntroPoints encrypts plaintext introduction points document for
+// clients with descriptor cookies according to authType. Stealth
+// authorization takes exactly one cookie.
+func EncryptIntroPoints(plaintext []byte, authType AuthType, cookies [][]byte) ([]byte, error) {
+	return encryptIntroPoints(rand.Reader, plaintext, authType, cookies)
+}
+
+func encryptIntroPoints(rand io.Reader, plaintext []byte, authType AuthType, cookies [][]byte) ([]byte, error) {
+	for _, cookie := range cookies {
+		if len(cookie) != DescriptorCookieLength {
+			return nil, fmt.Errorf("invalid descriptor cookie length %d", len(cookie))
+		}
+	}
+	iv := make([]byte, introBlockIVLength)
+	if _, err := io.ReadFull(rand, iv); err != nil {
+		return nil, err
+	}
+	switch authType {
+	case AuthTypeStealth:
+		if len(cookies) != 1 {
+			return nil, errors.New("stealth authorization requires exactly one cookie")
+		}
+		block, err := encryptIntroBlock(plaintext, cookies[0], iv)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{byte(AuthTypeStealth)}, block...), nil
+	case AuthTypeBasic:
+		if len(cookies) == 0 || len(cookies) > 255*basicAuthClientMultiple {
+			return nil, fmt.Errorf("invalid number of clients %d", len(cookies))
+		}
+		sessionKey := make([]byte, DescriptorCookieLength)
+		if _, err := io.ReadFull(rand, sessionKey); err != nil {
+			return nil, err
+		}
+		clientBlocks := 1 + (len(cookies)-1)/basicAuthClientMultiple
+		entries := make([][]byte, clientBlocks*basicAuthClientMultiple)
+		for i := range entries {
+			entry := make([]byte, basicAuthClientEntryLength)
+			if i >= len(cookies) { /* Fake client */
+				if _, err := io.ReadFull(rand, entry); err != nil {
+					return nil, err
+				}
+				entries[i] = entry
+				continue
+			}
+			encryptedKey, err := aesCTR(cookies[i], make([]byte, introBlockIVLength), sessionKey)
+			if err != nil {
+				return nil, err
+			}
+			copy(entry, basicAuthClientID(cookies[i], iv))
+			copy(entry[basicAuthClientIDLength:], encryptedKey)
+			entries[i] = entry
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return bytes.Compare(entries[i], entries[j]) < 0
+		})
+		block, err := encryptIntroBlock(plaintext, sessionKey, iv)
+		if err != nil {
+			return nil, err
+		}
+		enc := []byte{byte(AuthTypeBasic), byte(clientBlocks)}
+		enc = append(enc, bytes.Join(entries, nil)...)
+		return append(enc, block...), nil
+	default:
+		return nil, fmt.Errorf("unsupported client authorization type %v", authType)
+	}
+}
+
+// DecryptIntroPoints decrypts introduction points block encrypted for
+// the client with descriptor cookie.
+func DecryptIntroPoints(block, cookie []byte) ([]byte, error) {
+	authType, err := DetectAuthType(block)
+	if err != nil {
+		return nil, err
+	}
+	var plaintext []byte
+	switch authType {
+	case AuthTypeNone:
+		return nil, errors.New("introduction points are not encrypted")
+	case AuthTypeStealth:
+		plaintext, err = decryptIntroBlock(block[1:], cookie)
+		if err != nil {
+			return nil, err
+		}
+	case AuthTypeBasic:
+		if len(block) < 2 {
+			return nil, errors.New("encrypted block is too short")
+		}
+		entriesLength := int(block[1]) * basicAuthClientMultiple * basicAuthClientEntryLength
+		if len(block) < 2+entriesLength+introBlockIVLength {
+			return nil, errors.New("encrypted block is too short")
+		}
+		entries := block[2 : 2+entriesLength]
+		encrypted := block[2+entriesLength:]
+		clientID := basicAuthClientID(cookie, encrypted[:introBlockIVLength])
+		var sessionKey []byte
+		for i := 0; i < len(entries); i += basicAuthClientEntryLength {
+			entry := entries[i : i+basicAuthClientEntryLength]
+			if bytes.Equal(entry[:basicAuthClientIDLength], clientID) {
+				sessionKey, err = aesCTR(cookie, make([]byte, introBlockIVLength), entry[basicAuthClientIDLength:])
+				if err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		if sessionKey == nil {
+			return nil, errors.New("no client entry for the cookie")
+		}
+		plaintext, err = decryptIntroBlock(encrypted, sessionKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !bytes.HasPrefix(plaintext, []byte("introduction-point ")) {
+		return nil, errors.New("unable to decrypt introduction points: wrong cookie")
+	}
+	return plaintext, nil
+}
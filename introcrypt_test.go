@@ -0,0 +1,117 @@
+package onionutil
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// NIST SP 800-38A, F.5.1 CTR-AES128.Encrypt.
+const (
+	nistCTRKey        = "2b7e151628aed2a6abf7158809cf4f3c"
+	nistCTRCounter    = "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"
+	nistCTRPlaintext  = "6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411e5fbc1191a0a52eff69f2445df4f9b17ad2b417be66c3710"
+	nistCTRCiphertext = "874d6191b620e3261bef6864990db6ce9806f66b7970fdff8617187bb9fffdff5ae4df3edbd5d35e5b4f09020db03eab1e031dda2fbe03d1792170a0f3009cee"
+)
+
+func TestEncryptIntroBlock(t *testing.T) {
+	key := mustDecodeHex(nistCTRKey)
+	iv := mustDecodeHex(nistCTRCounter)
+	plaintext := mustDecodeHex(nistCTRPlaintext)
+	ciphertext := mustDecodeHex(nistCTRCiphertext)
+	block, err := encryptIntroBlock(plaintext, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block, append(iv, ciphertext...)) {
+		t.Fatalf("unexpected block %x", block)
+	}
+	decrypted, err := decryptIntroBlock(block, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatal("decrypted block differs")
+	}
+	if _, err := encryptIntroBlock(plaintext, key, iv[:8]); err == nil {
+		t.Error("short IV is accepted")
+	}
+}
+
+func TestStealthIntroPointsVector(t *testing.T) {
+	// Stealth block of rend-spec section 2.2 is the authorization type
+	// followed by IV and introduction points encrypted with the
+	// descriptor cookie, so NIST vector gives the expected block.
+	cookie := mustDecodeHex(nistCTRKey)
+	iv := mustDecodeHex(nistCTRCounter)
+	block, err := encryptIntroPoints(bytes.NewReader(iv), mustDecodeHex(nistCTRPlaintext), AuthTypeStealth, [][]byte{cookie})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "02" + nistCTRCounter + nistCTRCiphertext; hex.EncodeToString(block) != expected {
+		t.Fatalf("unexpected block %x", block)
+	}
+}
+
+func TestEncryptIntroPoints(t *testing.T) {
+	plaintext := MakeIntroPointsDocument(testIntroPoints(t, 2))
+	var cookies [][]byte
+	for i := 0; i < basicAuthClientMultiple+1; i++ {
+		cookies = append(cookies, testBytes(i, i+DescriptorCookieLength))
+	}
+	stranger := testBytes(100, 100+DescriptorCookieLength)
+
+	for _, tc := range []struct {
+		authType AuthType
+		cookies  [][]byte
+	}{
+		{AuthTypeStealth, cookies[:1]},
+		{AuthTypeBasic, cookies[:1]},
+		{AuthTypeBasic, cookies},
+	} {
+		block, err := EncryptIntroPoints(plaintext, tc.authType, tc.cookies)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authType, _ := DetectAuthType(block); authType != tc.authType {
+			t.Errorf("%v: detected %v", tc.authType, authType)
+		}
+		for i, cookie := range tc.cookies {
+			decrypted, err := DecryptIntroPoints(block, cookie)
+			if err != nil {
+				t.Errorf("%v: client %d: %v", tc.authType, i, err)
+				continue
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Errorf("%v: client %d: wrong plaintext", tc.authType, i)
+			}
+		}
+		if _, err := DecryptIntroPoints(block, stranger); err == nil {
+			t.Errorf("%v: decrypted with a foreign cookie", tc.authType)
+		}
+	}
+
+	// Given the same randomness encryption is deterministic.
+	random := bytes.Repeat([]byte{0x42}, 1024)
+	a, err := encryptIntroPoints(bytes.NewReader(random), plaintext, AuthTypeBasic, cookies[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := encryptIntroPoints(bytes.NewReader(random), plaintext, AuthTypeBasic, cookies[:2])
+	if !bytes.Equal(a, b) {
+		t.Error("encryption is not deterministic")
+	}
+	if len(a) != 2+basicAuthClientMultiple*basicAuthClientEntryLength+introBlockIVLength+len(plaintext) {
+		t.Errorf("unexpected basic block length %d", len(a))
+	}
+
+	if _, err := EncryptIntroPoints(plaintext, AuthTypeStealth, cookies[:2]); err == nil {
+		t.Error("stealth block for several clients")
+	}
+	if _, err := EncryptIntroPoints(plaintext, AuthTypeNone, cookies[:1]); err == nil {
+		t.Error("encrypted block without authorization")
+	}
+	if _, err := DecryptIntroPoints(plaintext, cookies[0]); err == nil {
+		t.Error("plaintext block is decrypted")
+	}
+}
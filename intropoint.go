@@ -9,13 +9,17 @@ package onionutil
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/rand"
 	"crypto/rsa"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"strings"
 
-	"github.com/nogoegst/onionutil/pkcs1"
 	"github.com/nogoegst/onionutil/torparse"
 )
 
@@ -25,47 +29,102 @@ type IntroductionPoint struct {
 	OnionPort       uint16
 	OnionKey        *rsa.PublicKey
 	ServiceKey      *rsa.PublicKey
+	// Signature is an optional signature of the introduction point by
+	// ServiceKey (see Sign). It is nil if there is none. This is an
+	// onionutil extension: rend-spec has no such field and tor doesn't
+	// check it.
+	Signature []byte
+	// Raw holds the original bytes of a parsed introduction point.
+	Raw []byte
 }
 
+// introPointSignatureKeyword is the keyword of introduction point
+// signature (an onionutil extension). It differs from "signature" used
+// to sign whole documents.
+const introPointSignatureKeyword = "service-signature"
+
+// IdentityLength is the length of relay identity (SHA1 digest of its
+// identity key).
+const IdentityLength = 20
+
+// ErrIdentityLength is returned for identities that don't decode to
+// IdentityLength bytes.
+type ErrIdentityLength struct {
+	Length int
+}
+
+func (e ErrIdentityLength) Error() string {
+	return fmt.Sprintf("invalid identity length %d", e.Length)
+}
+
+// DecodeIdentity decodes base32-encoded relay identity as found in
+// "introduction-point" lines. Trailing padding is tolerated.
+func DecodeIdentity(s string) ([]byte, error) {
+	identity, err := Base32Decode(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(identity) != IdentityLength {
+		return nil, ErrIdentityLength{len(identity)}
+	}
+	return identity, nil
+}
+
+// ParseIntroPoints parses introduction points from a plaintext
+// introduction points document. Each point starts with an
+// "introduction-point" line; the fields that follow it may come in
+// any order. Malformed points are logged and skipped. Signatures are
+// not verified, use Validate for that.
 func ParseIntroPoints(ips_str []byte) (ips []IntroductionPoint, rest string) {
-	docs, _rest := torparse.ParseTorDocument(ips_str)
-	for _, doc := range docs {
+	return parseIntroPoints(ips_str, logger)
+}
+
+// parseIntroPoints is ParseIntroPoints reporting malformed introduction
+// points to logger.
+func parseIntroPoints(ips_str []byte, logger Logger) (ips []IntroductionPoint, rest string) {
+	docs, _rest := torparse.ParseTorDocumentFull(ips_str)
+	for _, d := range docs {
+		doc := d.Fields
 		if _, ok := doc["introduction-point"]; !ok {
-			log.Printf("Got a document that is not an introduction point")
+			logger.Printf("Got a document that is not an introduction point")
 			continue
 		}
 		var ip IntroductionPoint
 
-		identity, err := Base32Decode(string(doc["introduction-point"].FJoined()))
+		identity, err := DecodeIdentity(string(doc["introduction-point"].FJoined()))
 		if err != nil {
-			log.Printf("The IP has invalid idenity. Skipping")
+			logger.Printf("The IP has invalid idenity: %v. Skipping", err)
 			continue
 		}
 		ip.Identity = identity
 
 		ip.InternetAddress = net.ParseIP(string(doc["ip-address"].FJoined()))
 		if ip.InternetAddress == nil {
-			log.Printf("Not a valid Internet address for an IntroPoint")
+			logger.Printf("Not a valid Internet address for an IntroPoint")
 			continue
 		}
 		onion_port, err := InetPortFromByteString(doc["onion-port"].FJoined())
 		if err != nil {
-			log.Printf("Error parsing IP port: %v", err)
+			logger.Printf("Error parsing IP port: %v", err)
 			continue
 		}
 		ip.OnionPort = onion_port
-		onion_key, _, err := pkcs1.DecodePublicKeyDER(doc["onion-key"].FJoined())
+		onion_key, err := decodePublicKey(doc["onion-key"].FJoined())
 		if err != nil {
-			log.Printf("Decoding DER sequence of PulicKey has failed: %v.", err)
+			logger.Printf("Decoding DER sequence of PulicKey has failed: %v.", err)
 			continue
 		}
 		ip.OnionKey = onion_key
-		service_key, _, err := pkcs1.DecodePublicKeyDER(doc["service-key"].FJoined())
+		service_key, err := decodePublicKey(doc["service-key"].FJoined())
 		if err != nil {
-			log.Printf("Decoding DER sequence of PulicKey has failed: %v.", err)
+			logger.Printf("Decoding DER sequence of PulicKey has failed: %v.", err)
 			continue
 		}
 		ip.ServiceKey = service_key
+		if value, ok := doc[introPointSignatureKeyword]; ok {
+			ip.Signature = value.FJoined()
+		}
+		ip.Raw = d.Raw
 
 		ips = append(ips, ip)
 	}
@@ -73,30 +132,250 @@ func ParseIntroPoints(ips_str []byte) (ips []IntroductionPoint, rest string) {
 	return ips, rest
 }
 
+// signedPart returns the part of ip covered by its signature: the
+// original bytes of a parsed ip or its encoding up to and including
+// the signature keyword line.
+func (ip IntroductionPoint) signedPart() ([]byte, error) {
+	if ip.Raw != nil {
+		i := bytes.LastIndex(ip.Raw, []byte("\n"+introPointSignatureKeyword+"\n"))
+		if i < 0 {
+			return nil, errors.New("no signature in raw introduction point")
+		}
+		return ip.Raw[:i+len(introPointSignatureKeyword)+2], nil
+	}
+	ip.Signature = nil
+	return append(ip.Bytes(), introPointSignatureKeyword+"\n"...), nil
+}
+
+// Sign signs ip with signer holding its service key.
+// The signature is made over the encoding of ip, so Raw is dropped.
+func (ip *IntroductionPoint) Sign(signer crypto.Signer) error {
+	ip.Raw = nil
+	body, err := ip.signedPart()
+	if err != nil {
+		return err
+	}
+	signature, err := signer.Sign(rand.Reader, documentDigest(body), crypto.Hash(0))
+	if err != nil {
+		return err
+	}
+	ip.Signature = signature
+	return nil
+}
+
+// Validate verifies signature of ip by its service key if ip is signed.
+// Parsed introduction points are verified over their original bytes.
+// Unsigned introduction points are considered valid.
+func (ip IntroductionPoint) Validate() error {
+	if ip.Signature == nil {
+		return nil
+	}
+	if ip.ServiceKey == nil {
+		return errors.New("introduction point has no service key")
+	}
+	body, err := ip.signedPart()
+	if err != nil {
+		return err
+	}
+	return rsa.VerifyPKCS1v15(ip.ServiceKey, 0, documentDigest(body), ip.Signature)
+}
+
+// Equal reports whether ip and other describe the same introduction point.
+func (ip IntroductionPoint) Equal(other IntroductionPoint) bool {
+	return bytes.Equal(ip.Identity, other.Identity) &&
+		ip.InternetAddress.Equal(other.InternetAddress) &&
+		ip.OnionPort == other.OnionPort &&
+		publicKeysEqual(ip.OnionKey, other.OnionKey) &&
+		publicKeysEqual(ip.ServiceKey, other.ServiceKey)
+}
+
+// RendezvousTarget holds what a client needs to initiate rendezvous via
+// an introduction point: the relay to extend a circuit to and the
+// service key to address INTRODUCE1 cell to.
+type RendezvousTarget struct {
+	// Identity, Address, Port and OnionKey describe the relay.
+	Identity []byte
+	Address  net.IP
+	Port     uint16
+	OnionKey *rsa.PublicKey
+	// ServiceKey is the key INTRODUCE1 cell is encrypted to.
+	ServiceKey *rsa.PublicKey
+	// ServiceKeyID is the hash of ServiceKey (PK_ID of INTRODUCE1 cell).
+	// It is nil if ServiceKey can't be encoded.
+	ServiceKeyID []byte
+}
+
+// RendezvousInfo extracts data needed to initiate rendezvous via ip.
+func (ip IntroductionPoint) RendezvousInfo() RendezvousTarget {
+	target := RendezvousTarget{
+		Identity:   ip.Identity,
+		Address:    ip.InternetAddress,
+		Port:       ip.OnionPort,
+		OnionKey:   ip.OnionKey,
+		ServiceKey: ip.ServiceKey,
+	}
+	if ip.ServiceKey != nil {
+		target.ServiceKeyID, _ = RSAPubkeyHash(ip.ServiceKey)
+	}
+	return target
+}
+
+// Bytes encodes ip the way tor does. Key blocks must be byte-for-byte
+// identical to tor's since the introduction points document may be
+// covered by a signature.
 // XXX: replace Falalf's with graceful errors
 func (ip IntroductionPoint) Bytes() (encodedIP []byte) {
 	w := new(bytes.Buffer)
 	fmt.Fprintf(w, "introduction-point %v\n", Base32Encode(ip.Identity))
 	fmt.Fprintf(w, "ip-address %v\n", ip.InternetAddress)
 	fmt.Fprintf(w, "onion-port %v\n", ip.OnionPort)
-	onionKeyDER, err := pkcs1.EncodePublicKeyDER(ip.OnionKey)
+	onionKeyPEM, err := EncodeKeyBlock(ip.OnionKey)
 	if err != nil {
 		log.Fatalf("Cannot encode public key into DER sequence.")
 	}
-	onionKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY",
-		Bytes: onionKeyDER})
 	fmt.Fprintf(w, "onion-key\n%s", onionKeyPEM)
-	serviceKeyDER, err := pkcs1.EncodePublicKeyDER(ip.ServiceKey)
+	serviceKeyPEM, err := EncodeKeyBlock(ip.ServiceKey)
 	if err != nil {
 		log.Fatalf("Cannot encode public key into DER sequence.")
 	}
-	serviceKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY",
-		Bytes: serviceKeyDER})
 	fmt.Fprintf(w, "service-key\n%s", serviceKeyPEM)
+	if ip.Signature != nil {
+		fmt.Fprintf(w, "%s\n", introPointSignatureKeyword)
+		pem.Encode(w, &pem.Block{Type: "SIGNATURE", Bytes: ip.Signature})
+	}
 
 	return w.Bytes()
 }
 
+// MakeIntroPointsDocument encodes ips into a plaintext introduction
+// points document.
+func MakeIntroPointsDocument(ips []IntroductionPoint) []byte {
+	w := new(bytes.Buffer)
+	for _, ip := range ips {
+		w.Write(ip.Bytes())
+	}
+	return w.Bytes()
+}
+
+// WriteIntroPointsFile writes ips to the file at path as a plaintext
+// introduction points document.
+func WriteIntroPointsFile(path string, ips []IntroductionPoint) error {
+	for i, ip := range ips {
+		if ip.OnionKey == nil || ip.ServiceKey == nil {
+			return fmt.Errorf("introduction point %d has no keys", i)
+		}
+	}
+	return ioutil.WriteFile(path, MakeIntroPointsDocument(ips), 0644)
+}
+
+// ReadIntroPointsFile reads introduction points from the file at path
+// written by WriteIntroPointsFile. Unlike ParseIntroPoints it fails if
+// any of introduction points is malformed.
+func ReadIntroPointsFile(path string) ([]IntroductionPoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	docs, rest := torparse.ParseTorDocument(data)
+	if len(bytes.TrimSpace(rest)) != 0 {
+		return nil, fmt.Errorf("%s: malformed introduction points document", path)
+	}
+	ips, _ := ParseIntroPoints(data)
+	if len(ips) != len(docs) {
+		return nil, fmt.Errorf("%s: %d of %d introduction points are malformed",
+			path, len(docs)-len(ips), len(docs))
+	}
+	return ips, nil
+}
+
+// SignIntroPointsDocument makes introduction points document of ips with
+// a signature appended the same way descriptors are signed: doSign is
+// called with the digest of the document up to and including the
+// "signature" keyword line.
+func SignIntroPointsDocument(ips []IntroductionPoint, doSign func([]byte) ([]byte, error)) ([]byte, error) {
+	w := bytes.NewBuffer(MakeIntroPointsDocument(ips))
+	fmt.Fprintf(w, "signature\n")
+	signature, err := doSign(documentDigest(w.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	pemSignature := pem.EncodeToMemory(&pem.Block{Type: "SIGNATURE", Bytes: signature})
+	fmt.Fprintf(w, "%s", pemSignature)
+	return w.Bytes(), nil
+}
+
+// DiversityRule reports whether introduction points a and b may be used
+// by the same service simultaneously.
+type DiversityRule func(a, b IntroductionPoint) bool
+
+// DistinctSubnets returns a rule that forbids introduction points in the
+// same IPv4 subnet of ipv4Bits prefix length or the same IPv6 subnet of
+// ipv6Bits prefix length.
+func DistinctSubnets(ipv4Bits, ipv6Bits int) DiversityRule {
+	return func(a, b IntroductionPoint) bool {
+		if a4, b4 := a.InternetAddress.To4(), b.InternetAddress.To4(); a4 != nil && b4 != nil {
+			mask := net.CIDRMask(ipv4Bits, 32)
+			return !a4.Mask(mask).Equal(b4.Mask(mask))
+		}
+		mask := net.CIDRMask(ipv6Bits, 128)
+		return !a.InternetAddress.Mask(mask).Equal(b.InternetAddress.Mask(mask))
+	}
+}
+
+// DistinctIdentities forbids using the same relay twice.
+func DistinctIdentities(a, b IntroductionPoint) bool {
+	return !bytes.Equal(a.Identity, b.Identity)
+}
+
+// DistinctFamilies returns a rule that forbids introduction points of
+// relays from the same family. family returns family name of a relay
+// with given identity or "" if it has no family.
+func DistinctFamilies(family func(identity []byte) string) DiversityRule {
+	return func(a, b IntroductionPoint) bool {
+		fa := family(a.Identity)
+		return fa == "" || fa != family(b.Identity)
+	}
+}
+
+// DefaultDiversityRules are the constraints tor applies: distinct
+// relays not sharing IPv4 /16 or IPv6 /32 subnet.
+var DefaultDiversityRules = []DiversityRule{
+	DistinctIdentities,
+	DistinctSubnets(16, 32),
+}
+
+// SelectIntroPoints selects n introduction points from candidates (in
+// their order) so that every pair of selected points satisfies all rules.
+// DefaultDiversityRules are used if no rules are given. Shuffle candidates
+// to get a random selection. n must be positive.
+func SelectIntroPoints(candidates []IntroductionPoint, n int, rules ...DiversityRule) ([]IntroductionPoint, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid number of introduction points %d", n)
+	}
+	if len(rules) == 0 {
+		rules = DefaultDiversityRules
+	}
+	var selected []IntroductionPoint
+Candidates:
+	for _, candidate := range candidates {
+		if len(selected) == n {
+			break
+		}
+		for _, ip := range selected {
+			for _, rule := range rules {
+				if !rule(ip, candidate) {
+					continue Candidates
+				}
+			}
+		}
+		selected = append(selected, candidate)
+	}
+	if len(selected) < n {
+		return nil, fmt.Errorf("only %d diverse introduction points available out of %d requested", len(selected), n)
+	}
+	return selected, nil
+}
+
 func (ip *IntroductionPoint) String() string {
 	return string(ip.Bytes())
 }
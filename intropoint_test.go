@@ -0,0 +1,333 @@
+package onionutil
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testIntroPoints(t testing.TB, n int) []IntroductionPoint {
+	pk := &testPrivateKey(t).PublicKey
+	var ips []IntroductionPoint
+	for i := 0; i < n; i++ {
+		ip := IntroductionPoint{
+			Identity:        make([]byte, 20),
+			InternetAddress: net.IPv4(10, byte(i), 0, 1),
+			OnionPort:       uint16(9001 + i),
+			OnionKey:        pk,
+			ServiceKey:      pk,
+		}
+		ip.Identity[0] = byte(i)
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func TestSignIntroPointsDocument(t *testing.T) {
+	sk := testPrivateKey(t)
+	ips := testIntroPoints(t, 2)
+	doc, err := SignIntroPointsDocument(ips, func(digest []byte) ([]byte, error) {
+		return sk.Sign(rand.Reader, digest, crypto.Hash(0))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := MakeIntroPointsDocument(ips)
+	if !bytes.HasPrefix(doc, signed) {
+		t.Fatal("signed document doesn't start with introduction points")
+	}
+	signed = append(signed, "signature\n"...)
+	block, rest := pem.Decode(doc[len(signed):])
+	if block == nil || block.Type != "SIGNATURE" || len(rest) != 0 {
+		t.Fatal("malformed signature block")
+	}
+	if err := rsa.VerifyPKCS1v15(&sk.PublicKey, 0, Hash(signed), block.Bytes); err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ := ParseIntroPoints(doc)
+	if len(parsed) != len(ips) {
+		t.Fatalf("expected %d introduction points, got %d", len(ips), len(parsed))
+	}
+
+	if _, err := SignIntroPointsDocument(ips, func([]byte) ([]byte, error) {
+		return nil, errors.New("no signer")
+	}); err == nil {
+		t.Fatal("signing error is not propagated")
+	}
+}
+
+func TestSelectIntroPoints(t *testing.T) {
+	candidates := testIntroPoints(t, 4)
+	candidates[0].InternetAddress = net.ParseIP("1.2.3.4")
+	candidates[1].InternetAddress = net.ParseIP("1.2.200.1") // same /16 as 0
+	candidates[2].InternetAddress = net.ParseIP("5.6.7.8")
+	candidates[3].InternetAddress = net.ParseIP("2001:db8::1")
+
+	selected, err := SelectIntroPoints(candidates, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, j := range []int{0, 2, 3} {
+		if !selected[i].InternetAddress.Equal(candidates[j].InternetAddress) {
+			t.Errorf("unexpected selection %v", selected[i].InternetAddress)
+		}
+	}
+	if _, err := SelectIntroPoints(candidates, 4); err == nil {
+		t.Error("no error for insufficient diverse candidates")
+	}
+	if _, err := SelectIntroPoints(candidates, 4, DistinctIdentities); err != nil {
+		t.Errorf("custom rules are not used: %v", err)
+	}
+	for _, n := range []int{0, -1} {
+		if _, err := SelectIntroPoints(candidates, n); err == nil {
+			t.Errorf("no error for %d introduction points", n)
+		}
+	}
+
+	family := func(identity []byte) string {
+		if identity[0] == 2 || identity[0] == 3 {
+			return "family"
+		}
+		return ""
+	}
+	_, err = SelectIntroPoints(candidates[2:], 2, DistinctFamilies(family))
+	if err == nil {
+		t.Error("relays of the same family are selected")
+	}
+}
+
+func TestDecodeIdentity(t *testing.T) {
+	identity := testBytes(0, IdentityLength)
+	encoded := Base32Encode(identity)
+	for _, s := range []string{encoded, strings.ToUpper(encoded), encoded + "===="} {
+		decoded, err := DecodeIdentity(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if !bytes.Equal(decoded, identity) {
+			t.Errorf("%s: wrong identity", s)
+		}
+	}
+	for _, n := range []int{10, 25, 30} {
+		_, err := DecodeIdentity(Base32Encode(testBytes(0, n)))
+		if err != (ErrIdentityLength{n}) {
+			t.Errorf("%d-byte identity: unexpected error %v", n, err)
+		}
+	}
+
+	ips := testIntroPoints(t, 3)
+	ips[1].Identity = testBytes(0, 10)
+	ips[2].Identity = testBytes(0, 25)
+	parsed, _ := ParseIntroPoints(MakeIntroPointsDocument(ips))
+	if len(parsed) != 1 || !bytes.Equal(parsed[0].Identity, ips[0].Identity) {
+		t.Errorf("introduction points with wrong identity length are accepted")
+	}
+}
+
+func TestRendezvousInfo(t *testing.T) {
+	ips := testIntroPoints(t, 2)
+	parsed, _ := ParseIntroPoints(MakeIntroPointsDocument(ips))
+	for i, ip := range parsed {
+		target := ip.RendezvousInfo()
+		if !bytes.Equal(target.Identity, ips[i].Identity) ||
+			!target.Address.Equal(ips[i].InternetAddress) ||
+			target.Port != ips[i].OnionPort {
+			t.Errorf("introduction point %d: wrong relay", i)
+		}
+		if target.OnionKey.N.Cmp(ips[i].OnionKey.N) != 0 ||
+			target.ServiceKey.N.Cmp(ips[i].ServiceKey.N) != 0 {
+			t.Errorf("introduction point %d: wrong keys", i)
+		}
+		keyID, _ := RSAPubkeyHash(ips[i].ServiceKey)
+		if !bytes.Equal(target.ServiceKeyID, keyID) {
+			t.Errorf("introduction point %d: wrong service key id", i)
+		}
+	}
+	if target := (IntroductionPoint{}).RendezvousInfo(); target.ServiceKeyID != nil {
+		t.Error("service key id without service key")
+	}
+}
+
+func TestIntroPointSignature(t *testing.T) {
+	sk := testPrivateKey(t)
+	ips := testIntroPoints(t, 2)
+	if err := ips[0].Validate(); err != nil {
+		t.Fatalf("unsigned introduction point is invalid: %v", err)
+	}
+	if err := ips[0].Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	if err := ips[0].Validate(); err != nil {
+		t.Fatal(err)
+	}
+	doc := MakeIntroPointsDocument(ips)
+	parsed, _ := ParseIntroPoints(doc)
+	if len(parsed) != 2 {
+		t.Fatalf("expected 2 introduction points, got %d", len(parsed))
+	}
+	if !bytes.Equal(parsed[0].Signature, ips[0].Signature) || parsed[1].Signature != nil {
+		t.Error("signatures are not preserved")
+	}
+
+	if err := parsed[0].Validate(); err != nil {
+		t.Error(err)
+	}
+
+	tampered := bytes.Replace(doc, []byte("onion-port 9001\n"), []byte("onion-port 9999\n"), 1)
+	parsed, _ = ParseIntroPoints(tampered)
+	if len(parsed) != 2 {
+		t.Fatalf("introduction points are dropped while parsing: %d left", len(parsed))
+	}
+	if err := parsed[0].Validate(); err == nil {
+		t.Error("tampered introduction point passes validation")
+	}
+	if err := parsed[1].Validate(); err != nil {
+		t.Error(err)
+	}
+
+	/* Wrap the key as other encoders may do and sign the result */
+	body := rewrapPEM(t, append(ips[1].Bytes(), introPointSignatureKeyword+"\n"...), "RSA PUBLIC KEY", 76)
+	sig, err := sk.Sign(rand.Reader, Hash(body), crypto.Hash(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(body, pem.EncodeToMemory(&pem.Block{Type: "SIGNATURE", Bytes: sig})...)
+	parsed, _ = ParseIntroPoints(data)
+	if len(parsed) != 1 {
+		t.Fatalf("expected 1 introduction point, got %d", len(parsed))
+	}
+	if err := parsed[0].Validate(); err != nil {
+		t.Errorf("introduction point is not verified over received bytes: %v", err)
+	}
+	parsed[0].Raw = nil
+	if err := parsed[0].Validate(); err == nil {
+		t.Error("re-encoded introduction point matches the received one")
+	}
+	ips[0].InternetAddress = net.IPv4(192, 0, 2, 1)
+	if err := ips[0].Validate(); err == nil {
+		t.Error("modified introduction point passes validation")
+	}
+}
+
+func TestParseIntroPointsFieldOrder(t *testing.T) {
+	ip := testIntroPoints(t, 1)[0]
+	onionKey, err := EncodeKeyBlock(ip.OnionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceKey, err := EncodeKeyBlock(ip.ServiceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := []string{
+		fmt.Sprintf("ip-address %v\n", ip.InternetAddress),
+		fmt.Sprintf("onion-port %v\n", ip.OnionPort),
+		fmt.Sprintf("onion-key\n%s", onionKey),
+		fmt.Sprintf("service-key\n%s", serviceKey),
+	}
+	header := fmt.Sprintf("introduction-point %v\n", Base32Encode(ip.Identity))
+
+	var permute func(k int)
+	permute = func(k int) {
+		if k == len(fields) {
+			doc := header + strings.Join(fields, "")
+			parsed, _ := ParseIntroPoints([]byte(doc + doc))
+			if len(parsed) != 2 {
+				t.Fatalf("expected 2 introduction points, got %d for:\n%s", len(parsed), doc)
+			}
+			for _, p := range parsed {
+				if !p.Equal(ip) {
+					t.Fatalf("introduction point is parsed incorrectly from:\n%s", doc)
+				}
+			}
+			return
+		}
+		for i := k; i < len(fields); i++ {
+			fields[k], fields[i] = fields[i], fields[k]
+			permute(k + 1)
+			fields[k], fields[i] = fields[i], fields[k]
+		}
+	}
+	permute(0)
+}
+
+func TestIntroPointsEncodingMatchesTor(t *testing.T) {
+	golden, err := ioutil.ReadFile("test/descriptors/hartwellnogoegst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs, _ := ParseOnionDescriptors(golden)
+	if len(descs) != 1 {
+		t.Fatalf("expected 1 descriptor, got %d", len(descs))
+	}
+	torBlock := descs[0].IntropointsBlock
+	ips := descs[0].IntroductionPoints
+	if len(ips) == 0 {
+		t.Fatal("no introduction points")
+	}
+	for i, ip := range ips {
+		encoded := ip.Bytes()
+		if !bytes.Contains(torBlock, encoded) {
+			t.Errorf("introduction point %d differs from tor's:\n%s", i, encoded)
+		}
+	}
+	if block := MakeIntroPointsDocument(ips); !bytes.Equal(block, torBlock) {
+		t.Fatalf("introduction points document differs from tor's:\n%s\n%s", block, torBlock)
+	}
+}
+
+func TestIntroPointsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onionutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "intro-points")
+
+	ips := testIntroPoints(t, 3)
+	if err := WriteIntroPointsFile(path, ips); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadIntroPointsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(ips) {
+		t.Fatalf("expected %d introduction points, got %d", len(ips), len(read))
+	}
+	for i := range ips {
+		if !read[i].Equal(ips[i]) {
+			t.Errorf("introduction point %d doesn't round-trip", i)
+		}
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	for name, malformed := range map[string][]byte{
+		"bad port":  bytes.Replace(data, []byte("onion-port 9002\n"), []byte("onion-port x\n"), 1),
+		"truncated": data[:len(data)-20],
+	} {
+		if err := ioutil.WriteFile(path, malformed, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadIntroPointsFile(path); err == nil {
+			t.Errorf("%s: malformed file is read", name)
+		}
+	}
+	if _, err := ReadIntroPointsFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing file is read")
+	}
+	if err := WriteIntroPointsFile(path, []IntroductionPoint{{Identity: make([]byte, IdentityLength)}}); err == nil {
+		t.Error("introduction point without keys is written")
+	}
+}
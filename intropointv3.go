@@ -0,0 +1,173 @@
+// intropointv3.go - deal with introduction points of v3 onion services
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/nogoegst/onionutil/torparse"
+)
+
+// IntroductionPointV3 is an introduction point from the inner (encrypted)
+// layer of v3 onion service descriptor.
+type IntroductionPointV3 struct {
+	LinkSpecifiers []byte
+	// OnionKey is the ntor key of the introduction point used to
+	// perform the handshake with it.
+	OnionKey    Curve25519Pubkey
+	AuthKeyCert []byte
+	EncKey      Curve25519Pubkey
+	EncKeyCert  []byte
+}
+
+// decodeBase64 decodes base64 data with or without padding.
+func decodeBase64(b []byte) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(string(b))
+	if err != nil {
+		data, err = base64.RawStdEncoding.DecodeString(string(b))
+	}
+	return data, err
+}
+
+// ParseNTorKeyEntry parses entry of the form "ntor <base64-key>" as found
+// in "onion-key" and "enc-key" fields of v3 introduction points.
+func ParseNTorKeyEntry(entry torparse.TorEntry) (key Curve25519Pubkey, err error) {
+	if len(entry) != 2 || string(entry[0]) != "ntor" {
+		return key, errors.New("not an ntor key")
+	}
+	data, err := decodeBase64(entry[1])
+	if err != nil {
+		return key, fmt.Errorf("unable to decode ntor key: %v", err)
+	}
+	if len(data) != Curve25519PubkeySize {
+		return key, fmt.Errorf("wrong ntor key length %d", len(data))
+	}
+	copy(key[:], data)
+	return key, nil
+}
+
+// InnerLayerV3 is the decrypted inner layer of v3 onion service
+// descriptor.
+type InnerLayerV3 struct {
+	// Create2Formats are handshake types of CREATE2 cells the service
+	// supports.
+	Create2Formats []int
+	// IntroAuthRequired are authentication types introduction points
+	// require. It is nil if the field is absent.
+	IntroAuthRequired []string
+	// SingleOnionService is set if the service is a single onion
+	// service.
+	SingleOnionService bool
+	IntroPoints        []IntroductionPointV3
+}
+
+const introPointV3Keyword = "introduction-point"
+
+// splitInnerLayerV3 splits the inner layer into the header and
+// introduction points that follow it.
+func splitInnerLayerV3(data []byte) (header, ips []byte) {
+	start := []byte(introPointV3Keyword + " ")
+	if bytes.HasPrefix(data, start) {
+		return nil, data
+	}
+	i := bytes.Index(data, append([]byte("\n"), start...))
+	if i < 0 {
+		return data, nil
+	}
+	return data[:i+1], data[i+1:]
+}
+
+// ParseInnerLayerV3 parses the decrypted inner layer of v3 descriptor:
+// the header starting with "create2-formats" followed by introduction
+// points.
+func ParseInnerLayerV3(data []byte) (*InnerLayerV3, error) {
+	header, ipsData := splitInnerLayerV3(data)
+	docs, _ := torparse.ParseTorDocument(header)
+	if len(docs) != 1 {
+		return nil, ErrMissingField{"create2-formats"}
+	}
+	doc := docs[0]
+	value, ok := doc["create2-formats"]
+	if !ok {
+		return nil, ErrMissingField{"create2-formats"}
+	}
+	if !torparse.ExactlyOnce(value) {
+		return nil, &FieldError{"create2-formats", ErrDuplicateField}
+	}
+	layer := new(InnerLayerV3)
+	for _, format := range value[0] {
+		n, err := strconv.Atoi(string(format))
+		if err != nil {
+			return nil, &FieldError{"create2-formats", err}
+		}
+		layer.Create2Formats = append(layer.Create2Formats, n)
+	}
+	if value, ok := doc["intro-auth-required"]; ok {
+		for _, authType := range value[0] {
+			layer.IntroAuthRequired = append(layer.IntroAuthRequired, string(authType))
+		}
+	}
+	_, layer.SingleOnionService = doc["single-onion-service"]
+	ips, err := parseIntroPointsV3(ipsData)
+	if err != nil {
+		return nil, err
+	}
+	layer.IntroPoints = ips
+	return layer, nil
+}
+
+// ParseIntroPointsV3 parses introduction points of the decrypted inner
+// layer of v3 descriptor. The layer header is skipped, use
+// ParseInnerLayerV3 to get it as well.
+func ParseIntroPointsV3(data []byte) (ips []IntroductionPointV3, err error) {
+	_, ipsData := splitInnerLayerV3(data)
+	return parseIntroPointsV3(ipsData)
+}
+
+// parseIntroPointsV3 parses data starting with the first introduction
+// point. Every "introduction-point" line starts a new one.
+func parseIntroPointsV3(data []byte) (ips []IntroductionPointV3, err error) {
+	docs, _ := torparse.ParseTorDocument(data)
+	for _, doc := range docs {
+		value, ok := doc[introPointV3Keyword]
+		if !ok {
+			continue
+		}
+		var ip IntroductionPointV3
+		ip.LinkSpecifiers, err = decodeBase64(value.FJoined())
+		if err != nil {
+			return nil, &FieldError{"introduction-point", err}
+		}
+		value, ok = doc["onion-key"]
+		if !ok {
+			return nil, &FieldError{"onion-key", errors.New("missing field")}
+		}
+		ip.OnionKey, err = ParseNTorKeyEntry(value[0])
+		if err != nil {
+			return nil, &FieldError{"onion-key", err}
+		}
+		if value, ok := doc["auth-key"]; ok {
+			ip.AuthKeyCert = value.FJoined()
+		}
+		if value, ok := doc["enc-key"]; ok {
+			ip.EncKey, err = ParseNTorKeyEntry(value[0])
+			if err != nil {
+				return nil, &FieldError{"enc-key", err}
+			}
+		}
+		if value, ok := doc["enc-key-cert"]; ok {
+			ip.EncKeyCert = value.FJoined()
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
@@ -0,0 +1,86 @@
+package onionutil
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestParseIntroPointsV3(t *testing.T) {
+	onionKey := testBytes(0, 32)
+	encKey := testBytes(32, 64)
+	doc := "introduction-point " + base64.StdEncoding.EncodeToString([]byte{1, 0, 6, 127, 0, 0, 1, 0x23, 0x29}) + "\n" +
+		"onion-key ntor " + base64.RawStdEncoding.EncodeToString(onionKey) + "\n" +
+		"auth-key\n" +
+		"-----BEGIN ED25519 CERT-----\n" +
+		"AQkABl6pAQ==\n" +
+		"-----END ED25519 CERT-----\n" +
+		"enc-key ntor " + base64.StdEncoding.EncodeToString(encKey) + "\n"
+	ips, err := ParseIntroPointsV3([]byte(doc + doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 {
+		t.Fatalf("expected 2 introduction points, got %d", len(ips))
+	}
+	if string(ips[0].OnionKey[:]) != string(onionKey) {
+		t.Error("wrong onion key")
+	}
+	if string(ips[0].EncKey[:]) != string(encKey) {
+		t.Error("wrong enc key")
+	}
+	if len(ips[0].AuthKeyCert) == 0 {
+		t.Error("auth key cert is not parsed")
+	}
+
+	short := "introduction-point AQAGfwAAASMp\n" +
+		"onion-key ntor " + base64.StdEncoding.EncodeToString(onionKey[:31]) + "\n"
+	if _, err := ParseIntroPointsV3([]byte(short)); err == nil {
+		t.Error("no error for short ntor key")
+	}
+	rsaKey := "introduction-point AQAGfwAAASMp\n" +
+		"onion-key rsa " + base64.StdEncoding.EncodeToString(onionKey) + "\n"
+	if _, err := ParseIntroPointsV3([]byte(rsaKey)); err == nil {
+		t.Error("no error for non-ntor onion key")
+	}
+}
+
+func TestParseInnerLayerV3(t *testing.T) {
+	var ips string
+	for i := 0; i < 3; i++ {
+		ips += "introduction-point " + base64.StdEncoding.EncodeToString([]byte{1, 0, 6, 127, 0, 0, byte(i + 1), 0x23, 0x29}) + "\n" +
+			"onion-key ntor " + base64.StdEncoding.EncodeToString(testBytes(i, i+32)) + "\n" +
+			"enc-key ntor " + base64.StdEncoding.EncodeToString(testBytes(32+i, 64+i)) + "\n"
+	}
+	data := []byte("create2-formats 2\n" + "intro-auth-required ed25519\n" + ips)
+	layer, err := ParseInnerLayerV3(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(layer.Create2Formats, []int{2}) ||
+		!reflect.DeepEqual(layer.IntroAuthRequired, []string{"ed25519"}) || layer.SingleOnionService {
+		t.Errorf("wrong layer header: %+v", layer)
+	}
+	if len(layer.IntroPoints) != 3 {
+		t.Fatalf("expected 3 introduction points, got %d", len(layer.IntroPoints))
+	}
+	for i, ip := range layer.IntroPoints {
+		if ip.LinkSpecifiers[6] != byte(i+1) || string(ip.OnionKey[:]) != string(testBytes(i, i+32)) {
+			t.Errorf("introduction point %d is mixed up", i)
+		}
+	}
+	parsed, err := ParseIntroPointsV3(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, layer.IntroPoints) {
+		t.Error("ParseIntroPointsV3 doesn't skip the header")
+	}
+
+	if _, err := ParseInnerLayerV3([]byte(ips)); err != (ErrMissingField{"create2-formats"}) {
+		t.Errorf("unexpected error for missing header: %v", err)
+	}
+	if _, err := ParseInnerLayerV3([]byte("create2-formats x\n" + ips)); err == nil {
+		t.Error("invalid create2-formats is accepted")
+	}
+}
@@ -8,11 +8,16 @@
 package onionutil
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 func LoadPrivateKeyFile(filename string) (crypto.PrivateKey, crypto.PublicKey, error) {
@@ -36,3 +41,41 @@ func LoadPrivateKeyFile(filename string) (crypto.PrivateKey, crypto.PublicKey, e
 		return nil, nil, fmt.Errorf("Unrecognized type of PEM block")
 	}
 }
+
+// DescriptorsFromServiceDir builds descriptors of all replicas of the
+// service stored in tor's hidden service directory dir (with
+// "private_key" and "hostname" files) at now, with introduction points
+// ips, and signs them. It returns encoded descriptors ready to upload.
+// ips must not be empty as clients can't reach a service without
+// introduction points.
+func DescriptorsFromServiceDir(dir string, now time.Time, ips []IntroductionPoint) ([][]byte, error) {
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no introduction points")
+	}
+	sk, _, err := LoadPrivateKeyFile(filepath.Join(dir, "private_key"))
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := sk.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not RSA")
+	}
+	hostname, err := ioutil.ReadFile(filepath.Join(dir, "hostname"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		match, err := AddressV2FromKey(&rsaKey.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if NormalizeOnionAddress(string(hostname)) != match.String() {
+			return nil, fmt.Errorf("hostname %s doesn't match private key", bytes.TrimSpace(hostname))
+		}
+	}
+	descs, err := BuildReplicaDescriptors(&rsaKey.PublicKey, ips, now)
+	if err != nil {
+		return nil, err
+	}
+	return signDescriptors(descs, rsaKey)
+}
@@ -0,0 +1,76 @@
+package onionutil
+
+import (
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDescriptorsFromServiceDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onionutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := ioutil.ReadFile("test/private_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "private_key"), key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sk, _, err := LoadPrivateKeyFile("test/private_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := &sk.(*rsa.PrivateKey).PublicKey
+	onionAddress, err := OnionAddressV2(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname := filepath.Join(dir, "hostname")
+	if err := ioutil.WriteFile(hostname, []byte(onionAddress+".onion\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1466539200, 0)
+	if _, err := DescriptorsFromServiceDir(dir, now, nil); err == nil {
+		t.Error("no error for missing introduction points")
+	}
+	ips := testIntroPoints(t, 3)
+	bodies, err := DescriptorsFromServiceDir(dir, now, ips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != MaxReplica-MinReplica+1 {
+		t.Fatalf("unexpected number of descriptors: %d", len(bodies))
+	}
+	for replica, body := range bodies {
+		descs, _, err := new(Parser).ParseOnionDescriptors(body)
+		if err != nil || len(descs) != 1 {
+			t.Fatalf("replica %d is not parsed: %v", replica, err)
+		}
+		if err := descs[0].VerifySignature(); err != nil {
+			t.Errorf("replica %d: %v", replica, err)
+		}
+		if ok, _ := descs[0].MatchesAddress(onionAddress); !ok {
+			t.Errorf("replica %d doesn't match the service", replica)
+		}
+		if len(descs[0].IntroductionPoints) != 3 {
+			t.Errorf("replica %d has %d introduction points", replica, len(descs[0].IntroductionPoints))
+		}
+	}
+
+	if err := ioutil.WriteFile(hostname, []byte("expyuzz4wqqyqhjn.onion\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DescriptorsFromServiceDir(dir, now, ips); err == nil {
+		t.Error("no error for mismatching hostname")
+	}
+	if _, err := DescriptorsFromServiceDir(filepath.Join(dir, "missing"), now, ips); err == nil {
+		t.Error("no error for missing directory")
+	}
+}
@@ -0,0 +1,41 @@
+// log.go - diagnostics output
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"log"
+)
+
+// Logger is the interface the package reports diagnostics (e.g. skipped
+// malformed documents) through. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+
+var logger Logger = stdLogger{}
+
+// SetLogger sets the package-wide logger. The default is the standard
+// logger of log package. nil silences diagnostics entirely.
+// It is not safe to call SetLogger concurrently with other functions
+// of the package.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	logger = l
+}
@@ -0,0 +1,68 @@
+package onionutil
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type testLogger []string
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, v...))
+}
+
+func TestSetLogger(t *testing.T) {
+	defer SetLogger(stdLogger{})
+	garbage := []byte("rendezvous-service-descriptor garbage\n")
+
+	l := new(testLogger)
+	SetLogger(l)
+	ParseOnionDescriptors(garbage)
+	if len(*l) != 1 {
+		t.Fatalf("expected 1 message, got %v", *l)
+	}
+
+	parserLogger := new(testLogger)
+	p := &Parser{Logger: parserLogger}
+	p.ParseOnionDescriptors(garbage)
+	if len(*l) != 1 || len(*parserLogger) != 1 {
+		t.Fatalf("parser logger is not used: %v, %v", *l, *parserLogger)
+	}
+
+	SetLogger(nil)
+	ParseOnionDescriptors(garbage)
+	ParseIntroPoints(garbage)
+}
+
+func TestParserLoggerIntroPoints(t *testing.T) {
+	defer SetLogger(stdLogger{})
+	l := new(testLogger)
+	SetLogger(l)
+
+	desc := &OnionDescriptor{}
+	desc.InitDefaults()
+	desc.PermanentKey = &testPrivateKey(t).PublicKey
+	ips := MakeIntroPointsDocument(testIntroPoints(t, 1))
+	desc.IntropointsBlock = bytes.Replace(ips, []byte("onion-port"), []byte("onion-port x\nx"), 1)
+	if err := desc.Finalize(time.Unix(1466539200, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := desc.Sign(testPrivateKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	parserLogger := new(testLogger)
+	p := &Parser{Logger: parserLogger}
+	descs, _, err := p.ParseOnionDescriptors(desc.Bytes())
+	if err != nil || len(descs) != 1 {
+		t.Fatalf("expected 1 descriptor, got %d: %v", len(descs), err)
+	}
+	if len(descs[0].IntroductionPoints) != 0 {
+		t.Fatal("malformed introduction point is not skipped")
+	}
+	if len(*l) != 0 || len(*parserLogger) != 1 {
+		t.Fatalf("parser logger is not used: %v, %v", *l, *parserLogger)
+	}
+}
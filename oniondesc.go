@@ -13,29 +13,59 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/nogoegst/onionutil/pkcs1"
 	"github.com/nogoegst/onionutil/torparse"
 )
 
 type OnionDescriptor struct {
-	DescID           []byte
-	Version          int
-	PermanentKey     *rsa.PublicKey
-	SecretIDPart     []byte
-	PublicationTime  time.Time
+	DescID          DescriptorID
+	Version         int
+	PermanentKey    *rsa.PublicKey
+	SecretIDPart    []byte
+	PublicationTime time.Time
+	// Lifetime is taken from the optional "descriptor-lifetime" field.
+	// Zero means DefaultDescriptorLifetime.
+	Lifetime         time.Duration
 	ProtocolVersions []int
 	IntropointsBlock []byte
-	Signature        []byte
-	Replica          int
+	// HadIntroPointsBlock is set if "introduction-points" field is
+	// present, even with an empty block. A descriptor without the field
+	// doesn't announce introduction points at all, while an empty block
+	// announces that there are none. Body emits an empty block if it
+	// is set.
+	HadIntroPointsBlock bool
+	// IntroductionPoints are decoded from IntropointsBlock. They are
+	// nil if the block is encrypted or wasn't decoded while parsing
+	// (see Parser.SkipIntroPoints).
+	IntroductionPoints []IntroductionPoint
+	// introPointsDecoded is set once IntroductionPoints are decoded.
+	introPointsDecoded bool
+	// AuthType is the client authorization type. IntropointsBlock
+	// is encrypted unless it is AuthTypeNone.
+	AuthType  AuthType
+	Signature []byte
+	Replica   int
+	// Annotations holds annotations (like "downloaded-at" or "source")
+	// that preceded the descriptor, keyed by their names without "@".
+	// It is nil if there were none.
+	Annotations map[string]string
+	// Raw holds the original bytes of a parsed descriptor. It is nil
+	// for descriptors that weren't parsed.
+	Raw []byte
+	// presentFields are keywords of fields found while parsing.
+	presentFields []string
 }
 
 var (
@@ -43,18 +73,78 @@ var (
 	MaxReplica       = 1
 	DescVersion      = 2
 	ProtocolVersions = []int{2, 3}
+	// KnownProtocolVersions is the set of introduction protocol
+	// versions defined for v2 onion services.
+	KnownProtocolVersions = []int{0, 1, 2, 3}
 )
 
+// supportedVersions are descriptor versions the package can both parse
+// and encode.
+var supportedVersions = []int{DescVersion}
+
+// SupportedVersions returns onion service descriptor versions this
+// package can parse and encode.
+func SupportedVersions() []int {
+	return append([]int(nil), supportedVersions...)
+}
+
+// SupportsV3 reports whether v3 descriptors are supported.
+func SupportsV3() bool {
+	for _, v := range supportedVersions {
+		if v == 3 {
+			return true
+		}
+	}
+	return false
+}
+
 // Initialize defaults
 func (desc *OnionDescriptor) InitDefaults() {
 	desc.Version = DescVersion
 	desc.ProtocolVersions = ProtocolVersions
 }
 
-// Finalize descriptor to sign.
+// NewOnionDescriptor creates a descriptor of replica replica for the service
+// with permanent key pk and introduction points ips, finalized at now.
+func NewOnionDescriptor(pk *rsa.PublicKey, ips []IntroductionPoint, replica int, now time.Time) (*OnionDescriptor, error) {
+	desc := &OnionDescriptor{}
+	desc.InitDefaults()
+	desc.PermanentKey = pk
+	desc.Replica = replica
+	if len(ips) > 0 {
+		desc.IntropointsBlock = MakeIntroPointsDocument(ips)
+		desc.IntroductionPoints = ips
+		desc.introPointsDecoded = true
+	}
+	if err := desc.Finalize(now); err != nil {
+		return nil, err
+	}
+	return desc, nil
+}
+
+// BuildReplicaDescriptors creates descriptors for all replicas of the
+// service with permanent key pk at time now. The descriptors are ready
+// to be signed and published.
+func BuildReplicaDescriptors(pk *rsa.PublicKey, ips []IntroductionPoint, now time.Time) ([]*OnionDescriptor, error) {
+	var descs []*OnionDescriptor
+	for replica := MinReplica; replica <= MaxReplica; replica++ {
+		desc, err := NewOnionDescriptor(pk, ips, replica, now)
+		if err != nil {
+			return nil, err
+		}
+		descs = append(descs, desc)
+	}
+	return descs, nil
+}
+
+// Finalize descriptor to sign. It fails if desc.Replica is not in
+// [MinReplica, MaxReplica] range as such descriptor is never looked up.
 func (desc *OnionDescriptor) Finalize(now time.Time) error {
+	if desc.Replica < MinReplica || desc.Replica > MaxReplica {
+		return fmt.Errorf("invalid replica %d", desc.Replica)
+	}
 	nowunix := now.Unix()
-	desc.PublicationTime = time.Unix(nowunix-nowunix%(60*60), 0)
+	desc.PublicationTime = NormalizePublicationTime(time.Unix(nowunix-nowunix%(60*60), 0))
 	permID, err := CalcPermanentID(desc.PermanentKey)
 	if err != nil {
 		return err
@@ -64,67 +154,626 @@ func (desc *OnionDescriptor) Finalize(now time.Time) error {
 	return nil
 }
 
+// NormalizePublicationTime converts t to the form publication times
+// have in descriptors: UTC with second resolution. Descriptors carry no
+// timezone, so formatting a time in any other zone changes digests.
+func NormalizePublicationTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+// DefaultDescriptorLifetime is the lifetime of v2 descriptors that don't
+// carry "descriptor-lifetime" field. It is the maximum age of descriptors
+// tor keeps in its cache (REND_CACHE_MAX_AGE).
+const DefaultDescriptorLifetime = 48 * time.Hour
+
+// ExpiresAt returns time when desc expires according to its lifetime.
+func (desc OnionDescriptor) ExpiresAt() time.Time {
+	lifetime := desc.Lifetime
+	if lifetime == 0 {
+		lifetime = DefaultDescriptorLifetime
+	}
+	return NormalizePublicationTime(desc.PublicationTime).Add(lifetime)
+}
+
+// IsExpired reports whether desc is expired at now.
+func (desc OnionDescriptor) IsExpired(now time.Time) bool {
+	return !now.Before(desc.ExpiresAt())
+}
+
+// Parser holds options controlling how onion service descriptors are parsed.
+// The zero value is ready to use.
+type Parser struct {
+	// AllowedProtocolVersions, if non-nil, makes the parser drop
+	// descriptors that announce a protocol version outside of it.
+	AllowedProtocolVersions []int
+	// Stats, if non-nil, is updated with statistics of parsed
+	// descriptors.
+	Stats *ParseStats
+	// Logger, if non-nil, is used instead of the package-wide logger.
+	Logger Logger
+	// MaxInputSize limits size of the whole data to parse in bytes.
+	// Zero or negative value means no limit.
+	MaxInputSize int
+	// DescriptorSizeLimit limits size of every descriptor in bytes to
+	// bound memory usage on untrusted input. Larger descriptors fail
+	// with ErrDescriptorTooLarge. Zero means MaxDescriptorSize, negative
+	// value means no limit.
+	DescriptorSizeLimit int
+	// SkipIntroPoints makes the parser keep introduction points block
+	// raw, leaving IntroductionPoints nil. It speeds up scanning when
+	// only descriptor metadata is needed. Use DecodeIntroPoints to
+	// decode them on demand.
+	SkipIntroPoints bool
+	// ReportSkipped makes the parser report documents other than onion
+	// service descriptors (like router descriptors in a mixed directory
+	// response) as errors. By default they are skipped silently.
+	ReportSkipped bool
+}
+
+// ErrInputTooLarge is returned when parser input exceeds the limit.
+var ErrInputTooLarge = errors.New("input is too large")
+
+// ErrDescriptorTooLarge is returned for descriptors larger than
+// Parser.DescriptorSizeLimit.
+var ErrDescriptorTooLarge = errors.New("descriptor is too large")
+
+func (p *Parser) inputTooLarge(size int) bool {
+	return p.MaxInputSize > 0 && size > p.MaxInputSize
+}
+
+func (p *Parser) descriptorSizeLimit() int {
+	if p.DescriptorSizeLimit == 0 {
+		return MaxDescriptorSize
+	}
+	return p.DescriptorSizeLimit
+}
+
+func (p *Parser) logger() Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return logger
+}
+
+// ParseStats holds statistics of descriptor parsing.
+type ParseStats struct {
+	Total  int
+	OK     int
+	Failed int
+	// Skipped counts documents other than onion service descriptors
+	// that were skipped silently (see Parser.ReportSkipped).
+	Skipped int
+	// Errors counts failures by the descriptor field that caused them.
+	Errors map[string]int
+}
+
+func (stats *ParseStats) add(err error) {
+	stats.Total++
+	if err == nil {
+		stats.OK++
+		return
+	}
+	stats.Failed++
+	if stats.Errors == nil {
+		stats.Errors = make(map[string]int)
+	}
+	reason := err.Error()
+	switch err := err.(type) {
+	case *FieldError:
+		reason = err.Field
+	case ErrMissingField:
+		reason = err.Field
+	case ErrUnsupportedVersion:
+		reason = "version"
+	}
+	stats.Errors[reason]++
+}
+
+// FieldError describes a problem with a particular descriptor field.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Field, e.Err)
+}
+
+// ErrMissingField is returned when a required descriptor field is absent
+// or empty.
+type ErrMissingField struct {
+	Field string
+}
+
+func (e ErrMissingField) Error() string {
+	return fmt.Sprintf("missing required field %s", e.Field)
+}
+
+// ErrUnsupportedVersion is returned for descriptors of versions other
+// than DescVersion, so they are not interpreted with v2 assumptions.
+type ErrUnsupportedVersion struct {
+	Version int
+}
+
+func (e ErrUnsupportedVersion) Error() string {
+	return fmt.Sprintf("unsupported descriptor version %d", e.Version)
+}
+
+// ErrDuplicateField is returned for fields that may appear in a
+// descriptor only once but are repeated.
+var ErrDuplicateField = errors.New("field appears more than once")
+
+// RequiredDescriptorFields are fields every v2 descriptor must have.
+var RequiredDescriptorFields = []string{
+	"rendezvous-service-descriptor",
+	"version",
+	"permanent-key",
+	"secret-id-part",
+	"publication-time",
+	"protocol-versions",
+	"signature",
+}
+
+// ErrNotOnionDescriptor is returned for documents that are not onion
+// service descriptors, e.g. by ParseDescriptorHeader or by
+// Parser.ParseAll with ReportSkipped set (wrapped in a DescriptorError).
+var ErrNotOnionDescriptor = errors.New("not an onion service descriptor")
+
+// Refresh prepares a (possibly parsed and modified) descriptor desc for
+// republishing as replica replica at time t: it recomputes DescID,
+// SecretIDPart and PublicationTime from the permanent key and drops
+// the stale signature.
+func (desc *OnionDescriptor) Refresh(t time.Time, replica byte) error {
+	desc.Replica = int(replica)
+	if err := desc.Finalize(t); err != nil {
+		return err
+	}
+	desc.Signature = nil
+	return nil
+}
+
 // TODO return a pointer to descs not descs themselves?
 func ParseOnionDescriptors(descsData []byte) (descs []OnionDescriptor, rest []byte) {
-	docs, rest := torparse.ParseTorDocument(descsData)
-	for _, doc := range docs {
-		var desc OnionDescriptor
-		if _, ok := doc["rendezvous-service-descriptor"]; !ok {
-			log.Printf("Got a document that is not an onion service")
+	p := new(Parser)
+	descs, rest, err := p.ParseOnionDescriptors(descsData)
+	if err != nil {
+		p.logger().Printf("Unable to parse descriptors: %v", err)
+	}
+	return descs, rest
+}
+
+// ParseOnionDescriptors parses all onion service descriptors in descsData
+// according to the options of p. Descriptors that fail to parse (including
+// ones larger than p.DescriptorSizeLimit) are skipped, as well as other
+// documents mixed in descsData (see Parser.ReportSkipped). An error is
+// returned if descsData is larger than p.MaxInputSize.
+func (p *Parser) ParseOnionDescriptors(descsData []byte) (descs []OnionDescriptor, rest []byte, err error) {
+	if p.inputTooLarge(len(descsData)) {
+		return nil, descsData, ErrInputTooLarge
+	}
+	descs, errs, rest := p.parseAll(descsData)
+	for _, err := range errs {
+		p.logger().Printf("Skipping descriptor: %v", err)
+	}
+
+	return descs, rest, nil
+}
+
+// DescriptorError describes a descriptor that failed to parse.
+type DescriptorError struct {
+	// Index is the position of the descriptor in the input, counting
+	// from zero.
+	Index int
+	Err   error
+}
+
+func (e *DescriptorError) Error() string {
+	return fmt.Sprintf("descriptor %d: %v", e.Index, e.Err)
+}
+
+// ParseAll parses all onion service descriptors in s. Unlike
+// ParseOnionDescriptors it reports every descriptor that fails to
+// parse as a *DescriptorError in errs, while still returning the
+// successfully parsed ones.
+func ParseAll(s string) (descs []OnionDescriptor, errs []error, rest string) {
+	return new(Parser).ParseAll(s)
+}
+
+// ParseAll is like the package-level ParseAll but uses the options of p.
+// If s is larger than p.MaxInputSize, errs holds only ErrInputTooLarge.
+func (p *Parser) ParseAll(s string) (descs []OnionDescriptor, errs []error, rest string) {
+	if p.inputTooLarge(len(s)) {
+		return nil, []error{ErrInputTooLarge}, s
+	}
+	descs, errs, restData := p.parseAll([]byte(s))
+	return descs, errs, string(restData)
+}
+
+func (p *Parser) parseAll(descsData []byte) (descs []OnionDescriptor, errs []error, rest []byte) {
+	docs, rest := torparse.ParseMixedDocumentsFull(descsData)
+	for i, doc := range docs {
+		desc, err := p.parseOnionDescriptor(doc)
+		if err == ErrNotOnionDescriptor && !p.ReportSkipped {
+			if p.Stats != nil {
+				p.Stats.Skipped++
+			}
 			continue
-		} else {
-			desc.DescID = doc["rendezvous-service-descriptor"].FJoined()
 		}
-
-		version, err := strconv.ParseInt(string(doc["version"].FJoined()), 10, 0)
+		if p.Stats != nil {
+			p.Stats.add(err)
+		}
 		if err != nil {
-			log.Printf("Error parsing descriptor version: %v", err)
+			errs = append(errs, &DescriptorError{Index: i, Err: err})
 			continue
 		}
-		desc.Version = int(version)
+		descs = append(descs, desc)
+	}
+	return descs, errs, rest
+}
+
+func (p *Parser) parseOnionDescriptor(d torparse.Document) (desc OnionDescriptor, err error) {
+	doc := d.Fields
+	if _, ok := doc["rendezvous-service-descriptor"]; !ok {
+		return desc, ErrNotOnionDescriptor
+	}
+	if limit := p.descriptorSizeLimit(); limit >= 0 && len(d.Raw) > limit {
+		return desc, ErrDescriptorTooLarge
+	}
+	desc.presentFields = doc.Keywords()
+	for _, field := range RequiredDescriptorFields {
+		if value, ok := doc[field]; !ok || len(value[0]) == 0 {
+			return desc, ErrMissingField{field}
+		}
+		if !torparse.ExactlyOnce(doc[field]) {
+			return desc, &FieldError{field, ErrDuplicateField}
+		}
+	}
+	if !torparse.AtMostOnce(doc["introduction-points"]) {
+		return desc, &FieldError{"introduction-points", ErrDuplicateField}
+	}
+	descID, err := ParseDescriptorID(string(doc["rendezvous-service-descriptor"].FJoined()))
+	if err != nil {
+		return desc, &FieldError{"rendezvous-service-descriptor", err}
+	}
+	desc.DescID = descID
+
+	version, err := strconv.ParseInt(string(doc["version"].FJoined()), 10, 0)
+	if err != nil {
+		return desc, &FieldError{"version", err}
+	}
+	desc.Version = int(version)
+	if desc.Version != DescVersion {
+		return desc, ErrUnsupportedVersion{desc.Version}
+	}
+
+	permanentKey, err := decodePublicKey(doc["permanent-key"].FJoined())
+	if err != nil {
+		return desc, &FieldError{"permanent-key", err}
+	}
+	desc.PermanentKey = permanentKey
+	desc.Annotations = parseAnnotations(doc)
+	desc.Raw = d.Raw
+
+	secretIDPart, err := Base32Decode(string(doc["secret-id-part"].FJoined()))
+	if err != nil {
+		return desc, &FieldError{"secret-id-part", err}
+	}
+	desc.SecretIDPart = secretIDPart
+
+	publicationTime, err := time.Parse(PublicationTimeFormat, string(doc["publication-time"].FJoined()))
+	if err != nil {
+		return desc, &FieldError{"publication-time", err}
+	}
+	desc.PublicationTime = NormalizePublicationTime(publicationTime)
+
+	if value, ok := doc["descriptor-lifetime"]; ok {
+		if !torparse.AtMostOnce(value) {
+			return desc, &FieldError{"descriptor-lifetime", ErrDuplicateField}
+		}
+		minutes, err := strconv.ParseUint(string(value.FJoined()), 10, 32)
+		if err != nil || minutes == 0 {
+			return desc, &FieldError{"descriptor-lifetime",
+				fmt.Errorf("invalid lifetime %q", value.FJoined())}
+		}
+		desc.Lifetime = time.Duration(minutes) * time.Minute
+	}
 
-		permanentKey, _, err := pkcs1.DecodePublicKeyDER(doc["permanent-key"].FJoined())
+	protocolVersions, err := ParseProtocolVersions(doc["protocol-versions"].FJoined())
+	if err != nil {
+		return desc, &FieldError{"protocol-versions", err}
+	}
+	desc.ProtocolVersions = protocolVersions
+	if p.AllowedProtocolVersions != nil {
+		if v, ok := unknownProtocolVersion(desc.ProtocolVersions, p.AllowedProtocolVersions); !ok {
+			return desc, &FieldError{"protocol-versions",
+				fmt.Errorf("disallowed protocol version %d", v)}
+		}
+	}
+
+	if value, ok := doc["introduction-points"]; ok {
+		if d.ObjectType("introduction-points") == "" {
+			return desc, &FieldError{"introduction-points",
+				errors.New("no introduction points block")}
+		}
+		desc.HadIntroPointsBlock = true
+		desc.IntropointsBlock = value.FJoined()
+		authType, err := DetectAuthType(desc.IntropointsBlock)
 		if err != nil {
-			log.Printf("Decoding DER sequence of PulicKey has failed: %v.", err)
-			continue
+			return desc, &FieldError{"introduction-points", err}
+		}
+		desc.AuthType = authType
+		if !p.SkipIntroPoints && desc.AuthType == AuthTypeNone {
+			desc.decodeIntroPoints(p.logger())
+		}
+	}
+
+	if objectType := d.ObjectType("signature"); objectType != "SIGNATURE" {
+		return desc, &FieldError{"signature",
+			fmt.Errorf("unexpected signature object type %q", objectType)}
+	}
+	desc.Signature = doc["signature"].FJoined()
+
+	return desc, nil
+}
+
+// DecodeIntroPoints decodes IntropointsBlock into IntroductionPoints on
+// demand, e.g. for descriptors parsed with Parser.SkipIntroPoints. The
+// result is cached: subsequent calls don't parse the block again.
+func (desc *OnionDescriptor) DecodeIntroPoints() error {
+	return desc.decodeIntroPoints(logger)
+}
+
+// decodeIntroPoints is DecodeIntroPoints reporting malformed
+// introduction points to l.
+func (desc *OnionDescriptor) decodeIntroPoints(l Logger) error {
+	if desc.introPointsDecoded {
+		return nil
+	}
+	if desc.AuthType != AuthTypeNone {
+		return fmt.Errorf("introduction points are encrypted (%v)", desc.AuthType)
+	}
+	desc.IntroductionPoints, _ = parseIntroPoints(desc.IntropointsBlock, l)
+	desc.introPointsDecoded = true
+	return nil
+}
+
+// ParseCachedDescriptors reads onion service descriptors from the file at
+// path as cached by tor, i.e. each descriptor may be preceded by
+// annotation lines like "@downloaded-at" and "@source".
+func ParseCachedDescriptors(path string) ([]OnionDescriptor, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	descs, _, err := new(Parser).ParseOnionDescriptors(data)
+	return descs, err
+}
+
+// ParseArmoredDescriptor parses a single descriptor encoded in base64
+// as one blob. Whitespace in s is ignored.
+func ParseArmoredDescriptor(s string) (*OnionDescriptor, error) {
+	return new(Parser).ParseArmoredDescriptor(s)
+}
+
+// ParseArmoredDescriptor is like the package-level ParseArmoredDescriptor
+// but uses the options of p.
+func (p *Parser) ParseArmoredDescriptor(s string) (*OnionDescriptor, error) {
+	s = strings.Join(strings.Fields(s), "")
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		data, err = base64.RawStdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode armored descriptor: %v", err)
 		}
-		desc.PermanentKey = permanentKey
-		desc.IntropointsBlock = doc["introduction-points"].FJoined()
+	}
+	return p.parseSingle(data, "armored blob")
+}
+
+// ParseDescriptorFromJSON parses a single descriptor carried as the
+// string field field of JSON object data, as produced by stem- or
+// onionoo-based tools.
+func ParseDescriptorFromJSON(data []byte, field string) (*OnionDescriptor, error) {
+	return new(Parser).ParseDescriptorFromJSON(data, field)
+}
 
-		if len(doc["signature"][0]) < 1 {
-			log.Printf("Empty signature")
+// ParseDescriptorFromJSON is like the package-level
+// ParseDescriptorFromJSON but uses the options of p.
+func (p *Parser) ParseDescriptorFromJSON(data []byte, field string) (*OnionDescriptor, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	raw, ok := obj[field]
+	if !ok {
+		return nil, fmt.Errorf("no field %q in JSON object", field)
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err != nil {
+		return nil, fmt.Errorf("field %q is not a string", field)
+	}
+	return p.parseSingle([]byte(text), fmt.Sprintf("field %q", field))
+}
+
+// parseSingle parses data that must hold exactly one descriptor
+// according to the options of p. source names data in errors.
+func (p *Parser) parseSingle(data []byte, source string) (*OnionDescriptor, error) {
+	if p.inputTooLarge(len(data)) {
+		return nil, ErrInputTooLarge
+	}
+	docs, _ := torparse.ParseTorDocumentFull(data)
+	if len(docs) != 1 {
+		return nil, fmt.Errorf("%s contains %d documents instead of a descriptor", source, len(docs))
+	}
+	desc, err := p.parseOnionDescriptor(docs[0])
+	if p.Stats != nil && err != ErrNotOnionDescriptor {
+		p.Stats.add(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &desc, nil
+}
+
+func parseAnnotations(doc torparse.TorDocument) (annotations map[string]string) {
+	for field, value := range doc {
+		if !torparse.IsAnnotation(field) {
 			continue
 		}
-		desc.Signature = doc["signature"].FJoined()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[strings.TrimPrefix(field, "@")] = string(value.FJoined())
+	}
+	return annotations
+}
 
-		descs = append(descs, desc)
+// maxProtocolVersionRange bounds the number of versions a single range
+// in "protocol-versions" may expand to.
+const maxProtocolVersionRange = 256
+
+// ParseProtocolVersions parses comma-separated list of protocol versions
+// as found in the "protocol-versions" field. List elements may be
+// single versions or ranges like "2-3" which are expanded.
+func ParseProtocolVersions(b []byte) (versions []int, err error) {
+	if len(b) == 0 {
+		return versions, nil
 	}
+	for _, s := range strings.Split(string(b), ",") {
+		bounds := strings.SplitN(s, "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid protocol version %q", s)
+		}
+		high := low
+		if len(bounds) == 2 {
+			high, err = strconv.Atoi(bounds[1])
+			if err != nil || high < low || high-low >= maxProtocolVersionRange {
+				return nil, fmt.Errorf("invalid protocol version range %q", s)
+			}
+		}
+		for v := low; v <= high; v++ {
+			versions = append(versions, v)
+		}
+	}
+	return versions, nil
+}
 
-	return descs, rest
+// unknownProtocolVersion reports the first version in versions that is not
+// in allowed. ok is false if such version exists.
+func unknownProtocolVersion(versions, allowed []int) (v int, ok bool) {
+	for _, v := range versions {
+		known := false
+		for _, a := range allowed {
+			if v == a {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return v, false
+		}
+	}
+	return 0, true
 }
 
-func (desc *OnionDescriptor) Bytes() []byte {
+// MaxDescriptorSize is the maximum size of encoded v2 descriptor
+// directory servers accept (REND_DESC_MAX_SIZE of tor).
+const MaxDescriptorSize = 20 * 1024
+
+// SizeWarningThreshold is the fraction of MaxDescriptorSize starting
+// from which SizeWarning reports descriptor size.
+const SizeWarningThreshold = 0.9
+
+// SizeError is returned by Validate if encoded descriptor is larger than
+// MaxDescriptorSize.
+type SizeError struct {
+	Size int
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("descriptor size %d exceeds the limit of %d bytes", e.Size, MaxDescriptorSize)
+}
+
+// EncodedSize returns size of desc in the encoded form.
+func (desc *OnionDescriptor) EncodedSize() (int, error) {
+	body, err := desc.Body()
+	if err != nil {
+		return 0, err
+	}
+	return len(body), nil
+}
+
+// SizeWarning reports whether desc is still publishable but its encoded
+// size is close to MaxDescriptorSize (see SizeWarningThreshold), so
+// adding more introduction points may make it too large.
+func (desc *OnionDescriptor) SizeWarning() bool {
+	size, err := desc.EncodedSize()
+	if err != nil {
+		return false
+	}
+	return size >= int(SizeWarningThreshold*MaxDescriptorSize) && size <= MaxDescriptorSize
+}
+
+// Validate performs sanity checks of desc that don't require
+// cryptographic operations. Unknown values are kept in desc as is.
+func (desc *OnionDescriptor) Validate() error {
+	if v, ok := unknownProtocolVersion(desc.ProtocolVersions, KnownProtocolVersions); !ok {
+		return fmt.Errorf("unknown protocol version %d", v)
+	}
+	size, err := desc.EncodedSize()
+	if err != nil {
+		return err
+	}
+	if size > MaxDescriptorSize {
+		return &SizeError{Size: size}
+	}
+	return nil
+}
+
+// Body encodes desc in the canonical form. Fields are always emitted
+// in the order defined by rend-spec (section 1.3) regardless of how desc
+// was populated:
+//
+//	rendezvous-service-descriptor
+//	version
+//	permanent-key
+//	secret-id-part
+//	publication-time
+//	descriptor-lifetime (omitted if Lifetime is zero)
+//	protocol-versions
+//	introduction-points (omitted if there are no introduction points
+//	                     unless HadIntroPointsBlock is set)
+//	signature
+//
+// Keys and blocks are PEM-encoded with 64-column lines, times are in
+// PublicationTimeFormat and protocol versions are comma-separated.
+// The same descriptor always encodes to the same bytes.
+func (desc *OnionDescriptor) Body() ([]byte, error) {
 	w := new(bytes.Buffer)
-	permPubKeyDER, err := pkcs1.EncodePublicKeyDER(desc.PermanentKey)
+	if desc.PermanentKey == nil {
+		return nil, errors.New("descriptor has no permanent key")
+	}
+	permPubKeyPEM, err := EncodeKeyBlock(desc.PermanentKey)
 	if err != nil {
-		log.Fatalf("Cannot encode public key into DER sequence.")
+		return nil, fmt.Errorf("cannot encode public key into DER sequence: %v", err)
 	}
-	fmt.Fprintf(w, "rendezvous-service-descriptor %s\n", Base32Encode(desc.DescID))
+	fmt.Fprintf(w, "rendezvous-service-descriptor %s\n", desc.DescID)
 	fmt.Fprintf(w, "version %d\n", desc.Version)
-	fmt.Fprintf(w, "permanent-key\n%s",
-		pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY",
-			Bytes: permPubKeyDER}))
+	fmt.Fprintf(w, "permanent-key\n%s", permPubKeyPEM)
 	fmt.Fprintf(w, "secret-id-part %s\n",
 		Base32Encode(desc.SecretIDPart))
 	fmt.Fprintf(w, "publication-time %v\n",
-		desc.PublicationTime.Format("2006-01-02 15:04:05"))
+		NormalizePublicationTime(desc.PublicationTime).Format(PublicationTimeFormat))
+	if desc.Lifetime > 0 {
+		fmt.Fprintf(w, "descriptor-lifetime %d\n", desc.Lifetime/time.Minute)
+	}
 	var protoversions []string
 	for _, v := range desc.ProtocolVersions {
 		protoversions = append(protoversions, fmt.Sprintf("%d", v))
 	}
 	fmt.Fprintf(w, "protocol-versions %v\n",
 		strings.Join(protoversions, ","))
-	if len(desc.IntropointsBlock) > 0 {
+	if len(desc.IntropointsBlock) > 0 || desc.HadIntroPointsBlock {
 		pemIntroBlock := &pem.Block{Type: "MESSAGE", Bytes: []byte(desc.IntropointsBlock)}
 		fmt.Fprintf(w, "introduction-points\n%s", pem.EncodeToMemory(pemIntroBlock))
 	}
@@ -133,7 +782,16 @@ func (desc *OnionDescriptor) Bytes() []byte {
 		pemSignature := pem.EncodeToMemory(&pem.Block{Type: "SIGNATURE", Bytes: desc.Signature})
 		fmt.Fprintf(w, "%s", pemSignature)
 	}
-	return w.Bytes()
+	return w.Bytes(), nil
+}
+
+// Bytes is like Body but exits on encoding errors.
+func (desc *OnionDescriptor) Bytes() []byte {
+	body, err := desc.Body()
+	if err != nil {
+		log.Fatalf("Cannot encode descriptor: %v", err)
+	}
+	return body
 }
 
 func (desc *OnionDescriptor) OnionID() (string, error) {
@@ -145,9 +803,170 @@ func (desc *OnionDescriptor) OnionID() (string, error) {
 	return onionID, nil
 }
 
+// IntroPointIdentities returns identities of relays used as introduction
+// points of desc in the order they appear in the descriptor. Introduction
+// points are decoded if they weren't yet (see DecodeIntroPoints).
+func (desc *OnionDescriptor) IntroPointIdentities() [][]byte {
+	if desc.AuthType != AuthTypeNone {
+		return nil
+	}
+	if desc.IntroductionPoints == nil {
+		desc.DecodeIntroPoints()
+	}
+	var identities [][]byte
+	for _, ip := range desc.IntroductionPoints {
+		identities = append(identities, ip.Identity)
+	}
+	return identities
+}
+
+// KV is a key/value pair.
+type KV struct {
+	Key   string
+	Value string
+}
+
+// Fields returns human-readable summary of desc as ordered key/value
+// pairs suitable for displaying as a table or marshaling to JSON.
+func (desc OnionDescriptor) Fields() []KV {
+	address, err := desc.OnionID()
+	if err != nil {
+		address = "invalid"
+	} else {
+		address += ".onion"
+	}
+	introPoints := fmt.Sprintf("%d", len(desc.IntroPointIdentities()))
+	if desc.AuthType != AuthTypeNone {
+		introPoints = "encrypted"
+	}
+	signature := "valid"
+	if len(desc.Signature) == 0 {
+		signature = "missing"
+	} else if err := desc.Verify(); err != nil {
+		signature = "invalid"
+	}
+	return []KV{
+		{"address", address},
+		{"descriptor-id", desc.DescID.String()},
+		{"version", fmt.Sprintf("%d", desc.Version)},
+		{"publication-time", NormalizePublicationTime(desc.PublicationTime).Format(PublicationTimeFormat)},
+		{"client-auth", desc.AuthType.String()},
+		{"introduction-points", introPoints},
+		{"signature", signature},
+	}
+}
+
+// SameService reports whether descriptors a and b belong to the same
+// onion service. Descriptor ids differ between replicas and time periods,
+// so permanent ids are compared instead.
+func SameService(a, b OnionDescriptor) bool {
+	if a.PermanentKey == nil || b.PermanentKey == nil {
+		return false
+	}
+	aID, err := CalcPermanentID(a.PermanentKey)
+	if err != nil {
+		return false
+	}
+	bID, err := CalcPermanentID(b.PermanentKey)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aID, bID)
+}
+
+// MatchesAddress reports whether desc belongs to the service with onion
+// address addr. It is the check to make sure a directory server returned
+// the descriptor of the requested service.
+func (desc OnionDescriptor) MatchesAddress(addr string) (bool, error) {
+	parsed, err := ParseOnionAddressV2(addr)
+	if err != nil {
+		return false, err
+	}
+	return desc.MatchesAddressV2(parsed), nil
+}
+
+// MatchesAddressV2 is like MatchesAddress but takes a parsed address.
+func (desc OnionDescriptor) MatchesAddressV2(addr AddressV2) bool {
+	return desc.PermanentKey != nil && addr.MatchesKey(desc.PermanentKey)
+}
+
+// ErrPermanentIDMismatch is returned when permanent key of a descriptor
+// doesn't correspond to the expected permanent id.
+var ErrPermanentIDMismatch = errors.New("permanent key doesn't match permanent id")
+
+// VerifyPermanentID checks that permanent key of desc hashes to permanent
+// id expected, e.g. the one decoded from the requested onion address.
+func (desc OnionDescriptor) VerifyPermanentID(expected []byte) error {
+	if len(expected) != OnionAddressLengthV2 {
+		return fmt.Errorf("invalid permanent id length %d", len(expected))
+	}
+	if desc.PermanentKey == nil {
+		return errors.New("descriptor has no permanent key")
+	}
+	permID, err := CalcPermanentID(desc.PermanentKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(permID, expected) {
+		return ErrPermanentIDMismatch
+	}
+	return nil
+}
+
+// SignatureAlgorithm names an algorithm descriptors are signed with.
+type SignatureAlgorithm string
+
+const (
+	// SignatureRSASHA1 is PKCS#1 v1.5 RSA signature of SHA1 digest
+	// used by v2 descriptors.
+	SignatureRSASHA1 SignatureAlgorithm = "RSA-SHA1"
+	// SignatureEd25519 is Ed25519 signature used by v3 descriptors.
+	SignatureEd25519 SignatureAlgorithm = "Ed25519"
+)
+
+// SignatureInfo is a self-describing descriptor signature.
+type SignatureInfo struct {
+	Algorithm SignatureAlgorithm
+	Signature []byte
+}
+
+// SignatureInfo returns signature of desc along with its algorithm.
+func (desc OnionDescriptor) SignatureInfo() SignatureInfo {
+	return SignatureInfo{
+		Algorithm: SignatureRSASHA1,
+		Signature: desc.Signature,
+	}
+}
+
+// BodyForSigning returns exactly the bytes the signature of desc covers:
+// encoded desc up to and including "signature" line. Hash it with Hash
+// and sign the digest, e.g. on an offline machine, then combine the
+// result with AttachSignature. It returns nil if desc can't be encoded.
+func (desc OnionDescriptor) BodyForSigning() []byte {
+	desc.Signature = nil
+	body, err := desc.Body()
+	if err != nil {
+		return nil
+	}
+	return body
+}
+
+// AttachSignature returns encoded desc with detached signature sig.
+// It returns nil if desc can't be encoded.
+func (desc OnionDescriptor) AttachSignature(sig []byte) []byte {
+	body := desc.BodyForSigning()
+	if body == nil {
+		return nil
+	}
+	return append(body, pem.EncodeToMemory(&pem.Block{Type: "SIGNATURE", Bytes: sig})...)
+}
+
 func (desc *OnionDescriptor) Sign(signer crypto.Signer) error {
-	descDigest := Hash(desc.Bytes())
-	signature, err := signer.Sign(rand.Reader, descDigest, crypto.Hash(0))
+	body := desc.BodyForSigning()
+	if body == nil {
+		return errors.New("unable to encode descriptor")
+	}
+	signature, err := signer.Sign(rand.Reader, documentDigest(body), crypto.Hash(0))
 	if err != nil {
 		return err
 	}
@@ -155,37 +974,238 @@ func (desc *OnionDescriptor) Sign(signer crypto.Signer) error {
 	return nil
 }
 
+// VerifySignature verifies signature of desc over its encoding. Use
+// VerifyRawSignature for received descriptors as other encoders may
+// produce bytes that differ from ours.
 func (desc *OnionDescriptor) VerifySignature() error {
-	signature := desc.Signature
-	desc.Signature = []byte{}
-	descDigest := Hash(desc.Bytes())
-	desc.Signature = signature
-	return rsa.VerifyPKCS1v15(desc.PermanentKey, 0, descDigest, signature)
+	body := desc.BodyForSigning()
+	if body == nil {
+		return errors.New("unable to encode descriptor")
+	}
+	return rsa.VerifyPKCS1v15(desc.PermanentKey, 0, documentDigest(body), desc.Signature)
+}
+
+// PresentFields returns sorted keywords of fields that were present in
+// the source of a parsed descriptor, including unknown ones. It returns
+// nil for descriptors that weren't parsed.
+func (desc OnionDescriptor) PresentFields() []string {
+	return desc.presentFields
+}
+
+// RawDigest returns digest of the original bytes of a parsed descriptor
+// up to and including "signature" line, i.e. the digest its signature
+// is made over.
+func (desc OnionDescriptor) RawDigest() ([]byte, error) {
+	if desc.Raw == nil {
+		return nil, errors.New("descriptor has no raw bytes")
+	}
+	i := bytes.LastIndex(desc.Raw, []byte("\nsignature\n"))
+	if i < 0 {
+		return nil, errors.New("no signature in raw descriptor")
+	}
+	return documentDigest(desc.Raw[:i+len("\nsignature\n")]), nil
+}
+
+// VerifyRawSignature verifies signature of a parsed descriptor desc over
+// its original bytes (see RawDigest).
+func (desc *OnionDescriptor) VerifyRawSignature() error {
+	digest, err := desc.RawDigest()
+	if err != nil {
+		return err
+	}
+	if desc.PermanentKey == nil {
+		return errors.New("descriptor has no permanent key")
+	}
+	return rsa.VerifyPKCS1v15(desc.PermanentKey, 0, digest, desc.Signature)
+}
+
+// DescriptorVersion returns desc.Version.
+func (desc *OnionDescriptor) DescriptorVersion() int {
+	return desc.Version
+}
+
+// Published returns desc.PublicationTime.
+func (desc *OnionDescriptor) Published() time.Time {
+	return desc.PublicationTime
+}
+
+// Address returns onion address of desc derived from its permanent key.
+func (desc *OnionDescriptor) Address() (string, error) {
+	if desc.PermanentKey == nil {
+		return "", errors.New("descriptor has no permanent key")
+	}
+	return OnionAddressV2(desc.PermanentKey)
+}
+
+// Verify verifies signature of desc (over its original bytes if desc
+// was parsed, see VerifyRawSignature) and that its descriptor id is
+// derived from its permanent key.
+func (desc *OnionDescriptor) Verify() error {
+	verify := desc.VerifySignature
+	if desc.Raw != nil {
+		verify = desc.VerifyRawSignature
+	}
+	if err := verify(); err != nil {
+		return err
+	}
+	return desc.VerifyKeyBinding()
+}
+
+// ErrKeyBinding is returned when descriptor id of a descriptor is not
+// derived from its permanent key.
+var ErrKeyBinding = errors.New("descriptor id doesn't match permanent key")
+
+// VerifyKeyBinding checks that DescID is derived from the permanent id of
+// PermanentKey and SecretIDPart. It detects descriptors whose permanent key
+// was replaced while the id was left intact: such a descriptor may carry a
+// valid signature made by the substituted key.
+func (desc *OnionDescriptor) VerifyKeyBinding() error {
+	if desc.PermanentKey == nil {
+		return errors.New("descriptor has no permanent key")
+	}
+	permID, err := CalcPermanentID(desc.PermanentKey)
+	if err != nil {
+		return err
+	}
+	if CalcDescriptorID(permID, desc.SecretIDPart) != desc.DescID {
+		return ErrKeyBinding
+	}
+	return nil
+}
+
+// TimePeriodLength is the length of v2 descriptor time period in seconds.
+const TimePeriodLength = 24 * 60 * 60
+
+// CalcTimePeriod calculates number of the time period the service with
+// permanent id permID is in at now. Periods of different services are
+// shifted by the first byte of their permanent ids:
+// (current-time + permanent-id-byte * 86400 / 256) / 86400.
+func CalcTimePeriod(permID []byte, now time.Time) uint32 {
+	permIDByte := int64(permID[0])
+	/* Don't truncate time before division as tor does 64-bit arithmetic */
+	return uint32((now.Unix() + permIDByte*TimePeriodLength/256) / TimePeriodLength)
+}
+
+// timePeriodStart returns the time period number period of the service
+// with permanent id permID starts at.
+func timePeriodStart(permID []byte, period uint32) time.Time {
+	offset := int64(permID[0]) * TimePeriodLength / 256
+	return time.Unix(int64(period)*TimePeriodLength-offset, 0)
 }
 
+// NextRotation returns the time secret id (and thus descriptor ids) of
+// the service with permanent key pk changes after now.
+func NextRotation(pk *rsa.PublicKey, now time.Time) (time.Time, error) {
+	permID, err := CalcPermanentID(pk)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return timePeriodStart(permID, CalcTimePeriod(permID, now)+1), nil
+}
+
+// Descriptor ids are derived by a chain of one-way hash functions:
+// permanent key -> permanent id (CalcPermanentID) -> secret id part
+// (CalcSecretID) -> descriptor id (CalcDescriptorID). There is no way
+// back from a descriptor id to the key, so walk the chain forward from
+// the key or onion address instead.
+
+// CalcSecretID calculates secret id part of the service with permanent id
+// permID at now for replica.
 /* TODO: there is no `descriptor-cookie` now (because we need IP list encryption etc) */
 func CalcSecretID(permID []byte, now time.Time, replica byte) (secretID []byte) {
-	permIDByte := uint32(permID[0])
+	return CalcSecretIDForPeriod(CalcTimePeriod(permID, now), replica)
+}
 
-	timePeriodInt := (uint32(now.Unix()) + permIDByte*86400/256) / 86400
+// CalcSecretIDForPeriod calculates secret id part for time period period
+// and replica: H(time-period | replica).
+func CalcSecretIDForPeriod(period uint32, replica byte) (secretID []byte) {
 	var timePeriod = new(bytes.Buffer)
-	binary.Write(timePeriod, binary.BigEndian, timePeriodInt)
+	binary.Write(timePeriod, binary.BigEndian, period)
 
-	h := sha1.New()
-	h.Write(timePeriod.Bytes())
-	h.Write([]byte{replica})
-	secretID = h.Sum(nil)
+	secretID = descriptorIDHash(timePeriod.Bytes(), []byte{replica})
 	return secretID
 }
 
-func CalcDescriptorID(permID, secretID []byte) (descID []byte) {
-	h := sha1.New()
-	h.Write(permID)
-	h.Write(secretID)
-	descID = h.Sum(nil)
+// CalcDescriptorID calculates descriptor id from permanent id and secret
+// id part: H(permanent-id | secret-id-part).
+func CalcDescriptorID(permID, secretID []byte) (descID DescriptorID) {
+	copy(descID[:], descriptorIDHash(permID, secretID))
 	return descID
 }
 
+// CalcDescriptorIDByKey calculates descriptor id of the service with
+// permanent key pk at now for replica.
+func CalcDescriptorIDByKey(pk *rsa.PublicKey, now time.Time, replica byte) (DescriptorID, error) {
+	permID, err := CalcPermanentID(pk)
+	if err != nil {
+		return DescriptorID{}, err
+	}
+	return CalcDescriptorID(permID, CalcSecretID(permID, now, replica)), nil
+}
+
+// DescriptorID is a v2 descriptor id.
+type DescriptorID [sha1.Size]byte
+
+// String returns base32 encoding of id as used in descriptors and
+// directory requests.
+func (id DescriptorID) String() string {
+	return Base32Encode(id[:])
+}
+
+// Hex returns hexadecimal encoding of id.
+func (id DescriptorID) Hex() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Bytes returns id as a byte slice.
+func (id DescriptorID) Bytes() []byte {
+	return id[:]
+}
+
+// ParseDescriptorID parses descriptor id s encoded either in base32 (as
+// returned by String) or in hex (as returned by Hex).
+func ParseDescriptorID(s string) (id DescriptorID, err error) {
+	var b []byte
+	switch len(s) {
+	case hex.EncodedLen(len(id)):
+		b, err = hex.DecodeString(s)
+	default:
+		b, err = Base32Decode(s)
+	}
+	if err != nil {
+		return id, err
+	}
+	if len(b) != len(id) {
+		return id, fmt.Errorf("descriptor id has wrong length %d", len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// UpcomingDescriptorIDs returns descriptor ids of all replicas of the
+// service with permanent key pk for n time periods following the one
+// now is in. Periods are shifted per key the same way tor does.
+func UpcomingDescriptorIDs(pk *rsa.PublicKey, now time.Time, n int) ([]DescriptorID, error) {
+	permID, err := CalcPermanentID(pk)
+	if err != nil {
+		return nil, err
+	}
+	var ids []DescriptorID
+	seen := make(map[DescriptorID]bool)
+	current := CalcTimePeriod(permID, now)
+	for i := 1; i <= n; i++ {
+		for replica := MinReplica; replica <= MaxReplica; replica++ {
+			id := CalcDescriptorID(permID, CalcSecretIDForPeriod(current+uint32(i), byte(replica)))
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
 func CalcDescIDByOnion(onion string, t time.Time, replica int) (string, error) {
 	permID, err := Base32Decode(onion)
 	if err != nil {
@@ -193,16 +1213,23 @@ func CalcDescIDByOnion(onion string, t time.Time, replica int) (string, error) {
 	}
 	secretID := CalcSecretID(permID, t, byte(replica))
 	descID := CalcDescriptorID(permID, secretID)
-	return Base32Encode(descID), nil
+	return descID.String(), nil
 }
 
 func (desc *OnionDescriptor) FullSign(signer crypto.Signer) error {
+	return desc.FullSignAt(signer, time.Now())
+}
+
+// FullSignAt finalizes desc at now and signs it with signer. Given the
+// same key, time and introduction points, the resulting descriptor is
+// byte-for-byte identical.
+func (desc *OnionDescriptor) FullSignAt(signer crypto.Signer, now time.Time) error {
 	var ok bool
 	desc.PermanentKey, ok = signer.Public().(*rsa.PublicKey)
 	if !ok {
 		return errors.New("signer is not RSA")
 	}
-	err := desc.Finalize(time.Now())
+	err := desc.Finalize(now)
 	if err != nil {
 		return fmt.Errorf("unable to update descriptor: %v", err)
 	}
@@ -0,0 +1,1497 @@
+package onionutil
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nogoegst/onionutil/pkcs1"
+	"github.com/nogoegst/onionutil/torparse"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+func testPrivateKey(t testing.TB) *rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		sk, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testKey = sk
+	})
+	return testKey
+}
+
+func testDescriptor(t *testing.T) *OnionDescriptor {
+	desc := &OnionDescriptor{}
+	desc.InitDefaults()
+	desc.PermanentKey = &testPrivateKey(t).PublicKey
+	if err := desc.Finalize(time.Unix(1466539200, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := desc.Sign(testPrivateKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+func TestParseProtocolVersions(t *testing.T) {
+	for s, expected := range map[string][]int{
+		"":        nil,
+		"2":       {2},
+		"2,3":     {2, 3},
+		"2-3":     {2, 3},
+		"0-1,3":   {0, 1, 3},
+		"0,2-3,5": {0, 2, 3, 5},
+		"3-3":     {3},
+	} {
+		versions, err := ParseProtocolVersions([]byte(s))
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+			continue
+		}
+		if !reflect.DeepEqual(versions, expected) {
+			t.Errorf("%q: got %v", s, versions)
+		}
+	}
+	for _, s := range []string{"a", "2,", "3-2", "2-", "-2", "2-3-4", "0-1000000000"} {
+		if _, err := ParseProtocolVersions([]byte(s)); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+
+	desc := testDescriptor(t)
+	desc.ProtocolVersions = []int{2, 999}
+	descs, _ := ParseOnionDescriptors(desc.Bytes())
+	if len(descs) != 1 {
+		t.Fatalf("expected 1 descriptor, got %d", len(descs))
+	}
+	if !reflect.DeepEqual(descs[0].ProtocolVersions, []int{2, 999}) {
+		t.Fatalf("protocol versions are not preserved: %v", descs[0].ProtocolVersions)
+	}
+	err := descs[0].Validate()
+	if err == nil || !strings.Contains(err.Error(), "999") {
+		t.Fatalf("unknown protocol version is not flagged: %v", err)
+	}
+
+	p := &Parser{AllowedProtocolVersions: KnownProtocolVersions}
+	descs, _, _ = p.ParseOnionDescriptors(desc.Bytes())
+	if len(descs) != 0 {
+		t.Fatalf("descriptor with unknown protocol version is accepted")
+	}
+
+	desc.ProtocolVersions = []int{2, 3}
+	descs, _, _ = p.ParseOnionDescriptors(desc.Bytes())
+	if len(descs) != 1 {
+		t.Fatalf("expected 1 descriptor, got %d", len(descs))
+	}
+	if err := descs[0].Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildReplicaDescriptors(t *testing.T) {
+	pk := &testPrivateKey(t).PublicKey
+	now := time.Unix(1466539200, 0)
+	descs, err := BuildReplicaDescriptors(pk, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descs) != MaxReplica-MinReplica+1 {
+		t.Fatalf("expected %d descriptors, got %d", MaxReplica-MinReplica+1, len(descs))
+	}
+	permID, err := CalcPermanentID(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, desc := range descs {
+		secretID := CalcSecretID(permID, now, byte(i))
+		if !reflect.DeepEqual(desc.SecretIDPart, secretID) {
+			t.Errorf("replica %d: wrong secret id part", i)
+		}
+		if !reflect.DeepEqual(desc.DescID, CalcDescriptorID(permID, secretID)) {
+			t.Errorf("replica %d: wrong descriptor id", i)
+		}
+	}
+	if reflect.DeepEqual(descs[0].DescID, descs[1].DescID) {
+		t.Fatal("replicas have the same descriptor id")
+	}
+}
+
+func TestSameService(t *testing.T) {
+	pk := &testPrivateKey(t).PublicKey
+	now := time.Unix(1466539200, 0)
+	descs, err := BuildReplicaDescriptors(pk, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later, err := NewOnionDescriptor(pk, nil, 0, now.Add(48*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !SameService(*descs[0], *descs[1]) {
+		t.Error("replicas are not recognized as the same service")
+	}
+	if !SameService(*descs[0], *later) {
+		t.Error("descriptors of different periods are not recognized as the same service")
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewOnionDescriptor(&otherKey.PublicKey, nil, 0, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if SameService(*descs[0], *other) {
+		t.Error("descriptors of different services are recognized as the same")
+	}
+}
+
+func TestIntroPointIdentities(t *testing.T) {
+	ips := testIntroPoints(t, 3)
+	desc, err := NewOnionDescriptor(&testPrivateKey(t).PublicKey, ips, 0, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities := desc.IntroPointIdentities()
+	if len(identities) != len(ips) {
+		t.Fatalf("expected %d identities, got %d", len(ips), len(identities))
+	}
+	for i, identity := range identities {
+		if !reflect.DeepEqual(identity, ips[i].Identity) {
+			t.Errorf("identity %d mismatch", i)
+		}
+	}
+
+	if err := desc.Sign(testPrivateKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	p := &Parser{SkipIntroPoints: true}
+	descs, _, err := p.ParseOnionDescriptors(desc.Bytes())
+	if err != nil || len(descs) != 1 {
+		t.Fatalf("unable to parse descriptor: %v", err)
+	}
+	if identities := descs[0].IntroPointIdentities(); !reflect.DeepEqual(identities, desc.IntroPointIdentities()) {
+		t.Error("identities of skipped introduction points differ")
+	}
+	if len(descs[0].IntroductionPoints) != len(ips) {
+		t.Error("decoded introduction points are not cached")
+	}
+}
+
+func TestParseCachedDescriptors(t *testing.T) {
+	descs, err := BuildReplicaDescriptors(&testPrivateKey(t).PublicKey, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cache []byte
+	for i, desc := range descs {
+		if err := desc.Sign(testPrivateKey(t)); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			cache = append(cache, "@downloaded-at 2016-06-21 20:10:00\n"...)
+			cache = append(cache, "@source \"127.0.0.1\"\n"...)
+		}
+		cache = append(cache, desc.Bytes()...)
+	}
+	dir, err := ioutil.TempDir("", "onionutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cached-descriptors")
+	if err := ioutil.WriteFile(path, cache, 0600); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseCachedDescriptors(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != len(descs) {
+		t.Fatalf("expected %d descriptors, got %d", len(descs), len(parsed))
+	}
+	expected := map[string]string{
+		"downloaded-at": "2016-06-21 20:10:00",
+		"source":        "\"127.0.0.1\"",
+	}
+	if !reflect.DeepEqual(parsed[0].Annotations, expected) {
+		t.Errorf("wrong annotations: %v", parsed[0].Annotations)
+	}
+	if parsed[1].Annotations != nil {
+		t.Errorf("unexpected annotations: %v", parsed[1].Annotations)
+	}
+	if _, err := ParseCachedDescriptors(filepath.Join(dir, "nonexistent")); err == nil {
+		t.Fatal("no error for nonexistent file")
+	}
+}
+
+func TestCanonicalBody(t *testing.T) {
+	golden, err := ioutil.ReadFile("test/descriptors/hartwellnogoegst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs, _ := ParseOnionDescriptors(golden)
+	if len(descs) != 1 {
+		t.Fatalf("expected 1 descriptor, got %d", len(descs))
+	}
+	body, err := descs[0].Body()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != string(golden) {
+		t.Fatalf("body is not canonical:\n%s", body)
+	}
+	if _, err := new(OnionDescriptor).Body(); err == nil {
+		t.Fatal("no error for descriptor without permanent key")
+	}
+}
+
+func TestParseStats(t *testing.T) {
+	desc := testDescriptor(t)
+	var data []byte
+	data = append(data, desc.Bytes()...)
+	desc.ProtocolVersions = []int{2, 999}
+	data = append(data, desc.Bytes()...)
+	data = append(data, desc.Bytes()...)
+	p := &Parser{
+		AllowedProtocolVersions: KnownProtocolVersions,
+		Stats:                   new(ParseStats),
+	}
+	descs, _, _ := p.ParseOnionDescriptors(data)
+	if len(descs) != 1 {
+		t.Fatalf("expected 1 descriptor, got %d", len(descs))
+	}
+	expected := &ParseStats{
+		Total:  3,
+		OK:     1,
+		Failed: 2,
+		Errors: map[string]int{"protocol-versions": 2},
+	}
+	if !reflect.DeepEqual(p.Stats, expected) {
+		t.Fatalf("wrong stats: %+v", p.Stats)
+	}
+}
+
+func TestParseConcatenatedDescriptors(t *testing.T) {
+	descs, err := BuildReplicaDescriptors(&testPrivateKey(t).PublicKey, testIntroPoints(t, 3), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for _, desc := range descs {
+		if err := desc.Sign(testPrivateKey(t)); err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, desc.Bytes()...)
+	}
+	parsed, rest := ParseOnionDescriptors(data)
+	if len(parsed) != len(descs) {
+		t.Fatalf("expected %d descriptors, got %d", len(descs), len(parsed))
+	}
+	if len(rest) != 0 {
+		t.Fatalf("some data left unparsed: %q", rest)
+	}
+	for i := range parsed {
+		if !reflect.DeepEqual(parsed[i].Bytes(), descs[i].Bytes()) {
+			t.Errorf("descriptor %d doesn't round-trip", i)
+		}
+	}
+}
+
+func TestParseArmoredDescriptor(t *testing.T) {
+	desc := testDescriptor(t)
+	armored := base64.StdEncoding.EncodeToString(desc.Bytes())
+	parsed, err := ParseArmoredDescriptor(armored[:50] + "\n" + armored[50:] + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed.Bytes(), desc.Bytes()) {
+		t.Fatal("armored descriptor doesn't round-trip")
+	}
+	if _, err := ParseArmoredDescriptor("not base64!"); err == nil {
+		t.Fatal("no error for invalid base64")
+	}
+	notDesc := base64.StdEncoding.EncodeToString([]byte("introduction-point abc\nip-address 127.0.0.1\n"))
+	_, err = ParseArmoredDescriptor(notDesc)
+	if err != ErrNotOnionDescriptor {
+		t.Fatalf("unexpected error for not a descriptor: %v", err)
+	}
+
+	stats := new(ParseStats)
+	p := &Parser{AllowedProtocolVersions: []int{3}, Stats: stats}
+	if _, err := p.ParseArmoredDescriptor(armored); err == nil {
+		t.Error("parser options are ignored")
+	}
+	if stats.Failed != 1 {
+		t.Errorf("parser statistics are not updated: %+v", stats)
+	}
+	p = &Parser{DescriptorSizeLimit: 100}
+	if _, err := p.ParseArmoredDescriptor(armored); err != ErrDescriptorTooLarge {
+		t.Errorf("descriptor size limit is ignored: %v", err)
+	}
+}
+
+func TestParseDescriptorFromJSON(t *testing.T) {
+	desc := testDescriptor(t)
+	data, err := json.Marshal(map[string]interface{}{
+		"descriptor": string(desc.Bytes()),
+		"fetched":    1466539200,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseDescriptorFromJSON(data, "descriptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed.Bytes(), desc.Bytes()) {
+		t.Fatal("descriptor doesn't round-trip")
+	}
+	for _, field := range []string{"missing", "fetched"} {
+		if _, err := ParseDescriptorFromJSON(data, field); err == nil {
+			t.Errorf("field %q is parsed", field)
+		}
+	}
+	if _, err := ParseDescriptorFromJSON([]byte("[]"), "descriptor"); err == nil {
+		t.Error("not an object is parsed")
+	}
+	p := &Parser{AllowedProtocolVersions: []int{3}}
+	if _, err := p.ParseDescriptorFromJSON(data, "descriptor"); err == nil {
+		t.Error("parser options are ignored")
+	}
+	p = &Parser{MaxInputSize: 100}
+	if _, err := p.ParseDescriptorFromJSON(data, "descriptor"); err != ErrInputTooLarge {
+		t.Errorf("input size limit is ignored: %v", err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	parsed, _ := ParseOnionDescriptors(testDescriptor(t).Bytes())
+	if len(parsed) != 1 {
+		t.Fatalf("expected 1 descriptor, got %d", len(parsed))
+	}
+	desc := parsed[0]
+	desc.IntropointsBlock = MakeIntroPointsDocument(testIntroPoints(t, 2))
+	now := time.Unix(1466539200, 0).Add(72 * time.Hour)
+	if err := desc.Refresh(now, 1); err != nil {
+		t.Fatal(err)
+	}
+	if desc.Signature != nil {
+		t.Fatal("stale signature is kept")
+	}
+	expected, err := NewOnionDescriptor(desc.PermanentKey, nil, 1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(desc.DescID, expected.DescID) {
+		t.Fatal("wrong descriptor id")
+	}
+	if !reflect.DeepEqual(desc.SecretIDPart, expected.SecretIDPart) {
+		t.Fatal("wrong secret id part")
+	}
+	if !desc.PublicationTime.Equal(expected.PublicationTime) {
+		t.Fatal("wrong publication time")
+	}
+	if err := desc.Sign(testPrivateKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := desc.VerifySignature(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSecretIDTimePeriods checks secret ids around boundaries of a time
+// period against the secret id part tor put into test/service-descriptor.
+// The service has permanent id byte 0x38 (hartwellnogoegst), so its
+// periods are shifted by 0x38*86400/256 = 18900 seconds and the descriptor
+// published at 1466539200 belongs to period 16974 lasting from
+// 1466534700 to 1466621099.
+func TestSecretIDTimePeriods(t *testing.T) {
+	data, err := ioutil.ReadFile("test/service-descriptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs, _ := ParseOnionDescriptors(data)
+	if len(descs) != 1 {
+		t.Fatal("unable to parse descriptor")
+	}
+	desc := descs[0]
+	permID, err := CalcPermanentID(desc.PermanentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if permID[0] != 0x38 || desc.PublicationTime.Unix() != 1466539200 {
+		t.Fatal("unexpected test descriptor")
+	}
+	replica := -1
+	for r := MinReplica; r <= MaxReplica; r++ {
+		if reflect.DeepEqual(CalcSecretID(permID, desc.PublicationTime, byte(r)), desc.SecretIDPart) {
+			replica = r
+		}
+	}
+	if replica < 0 {
+		t.Fatal("secret id part doesn't match publication time")
+	}
+	for now, same := range map[int64]bool{
+		1466534699: false,
+		1466534700: true,
+		1466621099: true,
+		1466621100: false,
+	} {
+		secretID := CalcSecretID(permID, time.Unix(now, 0), byte(replica))
+		if reflect.DeepEqual(secretID, desc.SecretIDPart) != same {
+			t.Errorf("%d: expected same secret id: %v", now, same)
+		}
+	}
+}
+
+func TestCalcTimePeriod(t *testing.T) {
+	vectors := []struct {
+		permIDByte byte
+		now        int64
+		period     uint32
+	}{
+		{0x00, 1466539200, 16973},
+		{0x00, 1466553599, 16973},
+		{0x00, 1466553600, 16974},
+		{0xd1, 1466483062, 16973},
+		{0xd1, 1466483063, 16974},
+		{0xff, 1466467201, 16973},
+	}
+	for _, v := range vectors {
+		period := CalcTimePeriod([]byte{v.permIDByte}, time.Unix(v.now, 0))
+		if period != v.period {
+			t.Errorf("%x at %d: expected %d, got %d", v.permIDByte, v.now, v.period, period)
+		}
+	}
+}
+
+func TestNextRotation(t *testing.T) {
+	pk := &testPrivateKey(t).PublicKey
+	now := time.Unix(1466539200, 0)
+	rotation, err := NextRotation(pk, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rotation.After(now) || rotation.Sub(now) > TimePeriodLength*time.Second {
+		t.Fatalf("rotation time %v is out of range", rotation)
+	}
+	before, err := NewOnionDescriptor(pk, nil, 0, rotation.Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := NewOnionDescriptor(pk, nil, 0, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := NewOnionDescriptor(pk, nil, 0, rotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(before.DescID, current.DescID) {
+		t.Fatal("descriptor id changes before rotation")
+	}
+	if reflect.DeepEqual(after.DescID, current.DescID) {
+		t.Fatal("descriptor id doesn't change at rotation")
+	}
+	next, err := NextRotation(pk, rotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Sub(rotation) != TimePeriodLength*time.Second {
+		t.Fatalf("wrong next rotation %v", next)
+	}
+}
+
+// TestGoldenDescriptors checks the whole digest/encoding/verification
+// chain against golden files in test/descriptors. The only one is
+// test/service-descriptor with the added unknown field removed, so
+// client authorization and non-canonical encodings are not covered here.
+func TestGoldenDescriptors(t *testing.T) {
+	files, err := filepath.Glob("test/descriptors/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no test descriptors found")
+	}
+	for _, file := range files {
+		golden, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		descs, rest := ParseOnionDescriptors(golden)
+		if len(descs) != 1 || len(rest) != 0 {
+			t.Errorf("%s: unable to parse", file)
+			continue
+		}
+		desc := descs[0]
+		if err := desc.VerifySignature(); err != nil {
+			t.Errorf("%s: %v", file, err)
+		}
+		permID, err := CalcPermanentID(desc.PermanentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(CalcDescriptorID(permID, desc.SecretIDPart), desc.DescID) {
+			t.Errorf("%s: descriptor id mismatch", file)
+		}
+		validSecretID := false
+		for replica := MinReplica; replica <= MaxReplica; replica++ {
+			secretID := CalcSecretID(permID, desc.PublicationTime, byte(replica))
+			if reflect.DeepEqual(secretID, desc.SecretIDPart) {
+				validSecretID = true
+			}
+		}
+		if !validSecretID {
+			t.Errorf("%s: secret id part doesn't match publication time", file)
+		}
+		body, err := desc.Body()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(body, golden) {
+			t.Errorf("%s: re-encoded descriptor differs", file)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	golden, err := ioutil.ReadFile("test/descriptors/hartwellnogoegst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs, _ := ParseOnionDescriptors(golden)
+	if len(descs) != 1 {
+		t.Fatalf("expected 1 descriptor, got %d", len(descs))
+	}
+	expected := []KV{
+		{"address", "hartwellnogoegst.onion"},
+		{"descriptor-id", "6iedtc4w36h35ln3ntklmbiawjhgdjud"},
+		{"version", "2"},
+		{"publication-time", "2016-06-21 20:00:00"},
+		{"client-auth", "none"},
+		{"introduction-points", "6"},
+		{"signature", "valid"},
+	}
+	if fields := descs[0].Fields(); !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("wrong fields: %v", fields)
+	}
+	descs[0].Signature[0] ^= 0xff
+	if fields := descs[0].Fields(); fields[len(fields)-1].Value != "invalid" {
+		t.Fatalf("wrong signature status: %v", fields[len(fields)-1])
+	}
+}
+
+// removeField removes field (including its PEM object) from descriptor body.
+func removeField(body []byte, field string) []byte {
+	var out []byte
+	removed, inObject := false, false
+	for _, line := range strings.SplitAfter(string(body), "\n") {
+		if removed && strings.HasPrefix(line, "-----BEGIN ") {
+			inObject = true
+		}
+		removed = false
+		if inObject {
+			inObject = !strings.HasPrefix(line, "-----END ")
+			continue
+		}
+		if strings.HasPrefix(line, field+" ") || line == field+"\n" {
+			removed = true
+			continue
+		}
+		out = append(out, line...)
+	}
+	return out
+}
+
+func TestMissingFields(t *testing.T) {
+	body := testDescriptor(t).Bytes()
+	for _, field := range RequiredDescriptorFields {
+		docs, _ := torparse.ParseTorDocumentFull(removeField(body, field))
+		if len(docs) != 1 {
+			t.Fatalf("%s: expected 1 document, got %d", field, len(docs))
+		}
+		_, err := new(Parser).parseOnionDescriptor(docs[0])
+		if field == "rendezvous-service-descriptor" {
+			if err != ErrNotOnionDescriptor {
+				t.Errorf("%s: unexpected error %v", field, err)
+			}
+			continue
+		}
+		if err != (ErrMissingField{field}) {
+			t.Errorf("%s: unexpected error %v", field, err)
+		}
+	}
+	docs, _ := torparse.ParseTorDocumentFull(removeField(body, "introduction-points"))
+	if _, err := new(Parser).parseOnionDescriptor(docs[0]); err != nil {
+		t.Errorf("introduction-points is optional: %v", err)
+	}
+}
+
+func TestMatchesAddress(t *testing.T) {
+	golden, err := ioutil.ReadFile("test/descriptors/hartwellnogoegst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs, _ := ParseOnionDescriptors(golden)
+	if len(descs) != 1 {
+		t.Fatalf("expected 1 descriptor, got %d", len(descs))
+	}
+	for _, addr := range []string{"hartwellnogoegst", "hartwellnogoegst.onion", " HartwellNogoegst.Onion\n"} {
+		ok, err := descs[0].MatchesAddress(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Errorf("%q doesn't match", addr)
+		}
+	}
+	if ok, err := descs[0].MatchesAddress("expyuzz4wqqyqhjn.onion"); ok || err != nil {
+		t.Errorf("wrong address matches: %v", err)
+	}
+	if _, err := descs[0].MatchesAddress("hartwell.onion"); err == nil {
+		t.Errorf("no error for invalid address")
+	}
+}
+
+func TestVerifyPermanentID(t *testing.T) {
+	golden, err := ioutil.ReadFile("test/descriptors/hartwellnogoegst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs, _ := ParseOnionDescriptors(golden)
+	if len(descs) != 1 {
+		t.Fatalf("expected 1 descriptor, got %d", len(descs))
+	}
+	permID, _ := Base32Decode("hartwellnogoegst")
+	if err := descs[0].VerifyPermanentID(permID); err != nil {
+		t.Fatal(err)
+	}
+	otherID, _ := Base32Decode("expyuzz4wqqyqhjn")
+	if err := descs[0].VerifyPermanentID(otherID); err != ErrPermanentIDMismatch {
+		t.Errorf("mismatch is not detected: %v", err)
+	}
+	if err := descs[0].VerifyPermanentID(permID[:5]); err == nil {
+		t.Error("short permanent id is accepted")
+	}
+	if err := (OnionDescriptor{}).VerifyPermanentID(permID); err == nil {
+		t.Error("descriptor without key is verified")
+	}
+}
+
+func TestSupportedVersions(t *testing.T) {
+	versions := SupportedVersions()
+	if !reflect.DeepEqual(versions, []int{2}) {
+		t.Fatalf("unexpected supported versions %v", versions)
+	}
+	versions[0] = 3
+	if SupportsV3() {
+		t.Fatal("supported versions are modifiable")
+	}
+}
+
+func TestMaxInputSize(t *testing.T) {
+	body := testDescriptor(t).Bytes()
+	p := &Parser{MaxInputSize: len(body)}
+	descs, _, err := p.ParseOnionDescriptors(body)
+	if err != nil || len(descs) != 1 {
+		t.Fatalf("descriptor within limit is not parsed: %v", err)
+	}
+	p.MaxInputSize = len(body) - 1
+	descs, rest, err := p.ParseOnionDescriptors(body)
+	if err != ErrInputTooLarge || descs != nil || len(rest) != len(body) {
+		t.Fatalf("limit is not enforced: %v", err)
+	}
+
+	huge := make([]byte, 10*MaxDescriptorSize)
+	if _, _, err := new(Parser).ParseOnionDescriptors(huge); err != nil {
+		t.Fatalf("input size is limited by default: %v", err)
+	}
+}
+
+func TestDescriptorSizeLimit(t *testing.T) {
+	small := testDescriptor(t).Bytes()
+	large := testDescriptor(t)
+	large.IntropointsBlock = MakeIntroPointsDocument(testIntroPoints(t, 1))
+	for len(large.IntropointsBlock) <= MaxDescriptorSize {
+		large.IntropointsBlock = append(large.IntropointsBlock, large.IntropointsBlock...)
+	}
+	if err := large.Sign(testPrivateKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	data := append(append(append([]byte(nil), small...), large.Bytes()...), small...)
+
+	descs, errs, _ := ParseAll(string(data))
+	if len(descs) != 2 {
+		t.Errorf("parsed %d descriptors instead of 2", len(descs))
+	}
+	if len(errs) != 1 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	if descErr, ok := errs[0].(*DescriptorError); !ok || descErr.Index != 1 || descErr.Err != ErrDescriptorTooLarge {
+		t.Errorf("unexpected error %v", errs[0])
+	}
+
+	p := &Parser{DescriptorSizeLimit: -1}
+	if descs, errs, _ := p.ParseAll(string(data)); len(descs) != 3 || len(errs) != 0 {
+		t.Errorf("unlimited parser: %d descriptors, errors %v", len(descs), errs)
+	}
+	p.DescriptorSizeLimit = len(small) - 1
+	if descs, _, _ := p.ParseAll(string(data)); len(descs) != 0 {
+		t.Errorf("%d descriptors exceeding the limit are parsed", len(descs))
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+func TestDeterministicSigning(t *testing.T) {
+	sk, _, err := LoadPrivateKeyFile("test/private_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := sk.(*rsa.PrivateKey)
+	pk := &signer.PublicKey
+	var ips []IntroductionPoint
+	for i := 0; i < 3; i++ {
+		ips = append(ips, IntroductionPoint{
+			Identity:        testBytes(i, i+20),
+			InternetAddress: net.IPv4(10, byte(i), 0, 1),
+			OnionPort:       uint16(9001 + i),
+			OnionKey:        pk,
+			ServiceKey:      pk,
+		})
+	}
+	now := time.Date(2016, 6, 21, 20, 30, 0, 0, time.FixedZone("UTC+3", 3*60*60))
+	desc, err := NewOnionDescriptor(pk, ips, 1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := desc.FullSignAt(signer, now); err != nil {
+		t.Fatal(err)
+	}
+	body, err := desc.Body()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *updateGolden {
+		if err := ioutil.WriteFile("test/signed-descriptor", body, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := ioutil.ReadFile("test/signed-descriptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(body, golden) {
+		t.Fatalf("signed descriptor differs from the golden one:\n%s", body)
+	}
+	if err := desc.VerifySignature(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	desc := testDescriptor(t)
+	for _, version := range []int{0, 1, 3} {
+		desc.Version = version
+		docs, _ := torparse.ParseTorDocumentFull(desc.Bytes())
+		_, err := new(Parser).parseOnionDescriptor(docs[0])
+		if err != (ErrUnsupportedVersion{version}) {
+			t.Errorf("version %d: unexpected error %v", version, err)
+		}
+	}
+	desc.Version = 1
+	p := &Parser{Stats: new(ParseStats)}
+	descs, _, _ := p.ParseOnionDescriptors(desc.Bytes())
+	if len(descs) != 0 || p.Stats.Errors["version"] != 1 {
+		t.Errorf("version 1 descriptor is accepted")
+	}
+}
+
+func TestEncodedSize(t *testing.T) {
+	desc := testDescriptor(t)
+	size, err := desc.EncodedSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len(desc.Bytes()) {
+		t.Fatalf("wrong size %d", size)
+	}
+	if err := desc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if desc.SizeWarning() {
+		t.Fatal("warning for small descriptor")
+	}
+	/* Grow introduction points block by a line at a time */
+	grow := func(limit int) {
+		for size <= limit {
+			desc.IntropointsBlock = append(desc.IntropointsBlock, make([]byte, 48)...)
+			if size, err = desc.EncodedSize(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	grow(int(SizeWarningThreshold * MaxDescriptorSize))
+	if err := desc.Validate(); err != nil {
+		t.Fatalf("descriptor close to the limit is invalid: %v", err)
+	}
+	if !desc.SizeWarning() {
+		t.Fatal("no warning for descriptor close to the limit")
+	}
+	grow(MaxDescriptorSize)
+	if _, ok := desc.Validate().(*SizeError); !ok {
+		t.Fatal("no error for too large descriptor")
+	}
+	if desc.SizeWarning() {
+		t.Error("warning for too large descriptor")
+	}
+}
+
+func TestAlternateKeyLabels(t *testing.T) {
+	sk := testPrivateKey(t)
+	desc, err := NewOnionDescriptor(&sk.PublicKey, testIntroPoints(t, 2), 0, time.Unix(1466539200, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := desc.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	body, err := desc.Body()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBlock, err := EncodeKeyBlock(&sk.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkix, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkixBlock := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix})
+	alt := strings.Replace(string(body), string(keyBlock), string(pkixBlock), -1)
+	alt = strings.Replace(alt, "-----BEGIN MESSAGE-----", "-----BEGIN INTRODUCTION POINTS-----", 1)
+	alt = strings.Replace(alt, "-----END MESSAGE-----", "-----END INTRODUCTION POINTS-----", 1)
+	if alt == string(body) {
+		t.Fatal("failed to relabel blocks")
+	}
+
+	descs, _, err := new(Parser).ParseOnionDescriptors([]byte(alt))
+	if err != nil || len(descs) != 1 {
+		t.Fatalf("unable to parse relabeled descriptor: %v", err)
+	}
+	parsed := descs[0]
+	if parsed.PermanentKey.N.Cmp(sk.PublicKey.N) != 0 {
+		t.Errorf("permanent key mismatch")
+	}
+	ips, _ := ParseIntroPoints(parsed.IntropointsBlock)
+	if len(ips) != 2 {
+		t.Errorf("unexpected number of introduction points: %d", len(ips))
+	}
+	reencoded, err := parsed.Body()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reencoded) != string(body) {
+		t.Errorf("relabeled descriptor is not re-encoded canonically")
+	}
+}
+
+func TestDescriptorIDChain(t *testing.T) {
+	sk := testPrivateKey(t)
+	now := time.Unix(1466539200, 0)
+
+	der, err := pkcs1.EncodePublicKeyDER(&sk.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derHash := sha1.Sum(der)
+	permID, err := CalcPermanentID(&sk.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(permID, derHash[:10]) {
+		t.Fatalf("wrong permanent id")
+	}
+
+	period := CalcTimePeriod(permID, now)
+	for _, replica := range []byte{0, 1} {
+		secretHash := sha1.Sum([]byte{byte(period >> 24), byte(period >> 16), byte(period >> 8), byte(period), replica})
+		secretID := CalcSecretIDForPeriod(period, replica)
+		if !bytes.Equal(secretID, secretHash[:]) {
+			t.Errorf("replica %d: wrong secret id part", replica)
+		}
+		if !bytes.Equal(CalcSecretID(permID, now, replica), secretID) {
+			t.Errorf("replica %d: CalcSecretID disagrees with CalcSecretIDForPeriod", replica)
+		}
+
+		descHash := sha1.Sum(append(append([]byte{}, permID...), secretID...))
+		descID := CalcDescriptorID(permID, secretID)
+		if descID != descHash {
+			t.Errorf("replica %d: wrong descriptor id", replica)
+		}
+		byKey, err := CalcDescriptorIDByKey(&sk.PublicKey, now, replica)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if byKey != descID {
+			t.Errorf("replica %d: CalcDescriptorIDByKey disagrees with the chain", replica)
+		}
+		byOnion, err := CalcDescIDByOnion(Base32Encode(permID), now, int(replica))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if byOnion != descID.String() {
+			t.Errorf("replica %d: CalcDescIDByOnion disagrees with the chain", replica)
+		}
+	}
+}
+
+func testCorpus(t testing.TB, n int) []byte {
+	sk := testPrivateKey(t)
+	var corpus []byte
+	for i := 0; i < n; i++ {
+		desc, err := NewOnionDescriptor(&sk.PublicKey, testIntroPoints(t, 3), i%2, time.Unix(1466539200, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := desc.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		corpus = append(corpus, desc.Bytes()...)
+	}
+	return corpus
+}
+
+func TestSkipIntroPoints(t *testing.T) {
+	corpus := testCorpus(t, 2)
+	descs, _, err := new(Parser).ParseOnionDescriptors(corpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descs[0].IntroductionPoints) != 3 {
+		t.Fatalf("introduction points are not decoded")
+	}
+	p := &Parser{SkipIntroPoints: true}
+	skipped, _, err := p.ParseOnionDescriptors(corpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != len(descs) {
+		t.Fatalf("expected %d descriptors, got %d", len(descs), len(skipped))
+	}
+	desc := &skipped[0]
+	if desc.IntroductionPoints != nil || len(desc.IntropointsBlock) == 0 {
+		t.Fatal("introduction points are decoded")
+	}
+	if err := desc.DecodeIntroPoints(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(desc.IntroductionPoints, descs[0].IntroductionPoints) {
+		t.Error("introduction points decoded later differ")
+	}
+	skipped[1].AuthType = AuthTypeBasic
+	if err := skipped[1].DecodeIntroPoints(); err == nil {
+		t.Error("no error for encrypted introduction points")
+	}
+}
+
+func benchmarkParse(b *testing.B, p *Parser) {
+	corpus := testCorpus(b, 100)
+	b.SetBytes(int64(len(corpus)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := p.ParseOnionDescriptors(corpus); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	benchmarkParse(b, &Parser{})
+}
+
+func BenchmarkParseSkipIntroPoints(b *testing.B) {
+	benchmarkParse(b, &Parser{SkipIntroPoints: true})
+}
+
+func TestDecodeIntroPoints(t *testing.T) {
+	p := &Parser{SkipIntroPoints: true}
+	descs, _, err := p.ParseOnionDescriptors(testCorpus(t, 1))
+	if err != nil || len(descs) != 1 {
+		t.Fatalf("unable to parse descriptor: %v", err)
+	}
+	desc := &descs[0]
+	if err := desc.DecodeIntroPoints(); err != nil {
+		t.Fatal(err)
+	}
+	if len(desc.IntroductionPoints) != 3 {
+		t.Fatalf("expected 3 introduction points, got %d", len(desc.IntroductionPoints))
+	}
+	// Cached result must be returned without parsing the block again.
+	desc.IntropointsBlock = MakeIntroPointsDocument(testIntroPoints(t, 1))
+	if err := desc.DecodeIntroPoints(); err != nil {
+		t.Fatal(err)
+	}
+	if len(desc.IntroductionPoints) != 3 {
+		t.Error("introduction points are decoded again")
+	}
+}
+
+func TestDuplicateFields(t *testing.T) {
+	body := string(testCorpus(t, 1))
+	for _, line := range []string{"version 2\n", "protocol-versions 2,3\n"} {
+		duplicated := strings.Replace(body, line, line+line, 1)
+		docs, _ := torparse.ParseTorDocumentFull([]byte(duplicated))
+		_, err := new(Parser).parseOnionDescriptor(docs[0])
+		if e, ok := err.(*FieldError); !ok || e.Err != ErrDuplicateField {
+			t.Errorf("%q: unexpected error %v", line, err)
+		}
+	}
+}
+
+func TestNormalizePublicationTime(t *testing.T) {
+	utc := time.Date(2016, 6, 21, 20, 0, 0, 0, time.UTC)
+	local := utc.Add(500 * time.Millisecond).In(time.FixedZone("UTC+3", 3*60*60))
+	normalized := NormalizePublicationTime(local)
+	if normalized != utc {
+		t.Fatalf("wrong normalized time %v", normalized)
+	}
+
+	desc := testDescriptor(t)
+	body := desc.Bytes()
+	desc.PublicationTime = local
+	if string(desc.Bytes()) != string(body) {
+		t.Error("encoding depends on timezone")
+	}
+	descs, _ := ParseOnionDescriptors(body)
+	if len(descs) != 1 || descs[0].PublicationTime != desc.PublicationTime.UTC().Truncate(time.Second) {
+		t.Error("parsed publication time is not normalized")
+	}
+}
+
+func TestSignatureInfo(t *testing.T) {
+	desc := testDescriptor(t)
+	info := desc.SignatureInfo()
+	if info.Algorithm != SignatureRSASHA1 {
+		t.Errorf("unexpected algorithm %s", info.Algorithm)
+	}
+	if !bytes.Equal(info.Signature, desc.Signature) {
+		t.Error("wrong signature")
+	}
+}
+
+func TestInvalidReplica(t *testing.T) {
+	pk := &testPrivateKey(t).PublicKey
+	now := time.Unix(1466539200, 0)
+	for _, replica := range []int{-1, MaxReplica + 1, 256} {
+		if _, err := NewOnionDescriptor(pk, nil, replica, now); err == nil {
+			t.Errorf("replica %d is accepted", replica)
+		}
+	}
+	desc := testDescriptor(t)
+	if err := desc.Refresh(now, byte(MaxReplica+1)); err == nil {
+		t.Error("Refresh accepts invalid replica")
+	}
+}
+
+func TestDetachedSignature(t *testing.T) {
+	sk := testPrivateKey(t)
+	desc := testDescriptor(t)
+	online := desc.Bytes()
+
+	desc.Signature = nil
+	body := desc.BodyForSigning()
+	if !strings.HasSuffix(string(body), "\nsignature\n") {
+		t.Fatalf("body doesn't end with signature keyword")
+	}
+	// Offline signer only sees the digest.
+	sig, err := rsa.SignPKCS1v15(nil, sk, 0, Hash(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := desc.AttachSignature(sig)
+	if string(signed) != string(online) {
+		t.Error("descriptor with attached signature differs from the one signed online")
+	}
+	descs, _ := ParseOnionDescriptors(signed)
+	if len(descs) != 1 {
+		t.Fatal("descriptor with attached signature is not parsed")
+	}
+	if err := descs[0].VerifySignature(); err != nil {
+		t.Error(err)
+	}
+
+	// Re-signing a signed descriptor doesn't cover the old signature.
+	desc.Signature = []byte("stale")
+	if err := desc.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	if err := desc.VerifySignature(); err != nil {
+		t.Error(err)
+	}
+	if (&OnionDescriptor{}).BodyForSigning() != nil {
+		t.Error("body of descriptor without key")
+	}
+}
+
+func TestSignatureObjectType(t *testing.T) {
+	body := string(testDescriptor(t).Bytes())
+	mislabeled := strings.Replace(body, "BEGIN SIGNATURE", "BEGIN MESSAGE", 1)
+	mislabeled = strings.Replace(mislabeled, "END SIGNATURE", "END MESSAGE", 1)
+	i := strings.Index(body, "signature\n")
+	inline := body[:i] + "signature AAECAwQF\n"
+	for name, data := range map[string]string{"mislabeled": mislabeled, "inline": inline} {
+		docs, _ := torparse.ParseTorDocumentFull([]byte(data))
+		_, err := new(Parser).parseOnionDescriptor(docs[0])
+		if e, ok := err.(*FieldError); !ok || e.Field != "signature" {
+			t.Errorf("%s signature: unexpected error %v", name, err)
+		}
+	}
+}
+
+func TestUpcomingDescriptorIDs(t *testing.T) {
+	pk := &testPrivateKey(t).PublicKey
+	now := time.Unix(1466539200, 0)
+	ids, err := UpcomingDescriptorIDs(pk, now, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3*(MaxReplica-MinReplica+1) {
+		t.Fatalf("unexpected number of ids: %d", len(ids))
+	}
+	next, err := NextRotation(pk, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	for period := 0; period < 3; period++ {
+		at := next.Add(time.Duration(period) * TimePeriodLength * time.Second)
+		for replica := MinReplica; replica <= MaxReplica; replica++ {
+			expected, _ := CalcDescriptorIDByKey(pk, at, byte(replica))
+			if ids[i] != expected {
+				t.Errorf("period %d replica %d: wrong id %s", period, replica, ids[i])
+			}
+			i++
+		}
+	}
+	current, _ := CalcDescriptorIDByKey(pk, now, 0)
+	for _, id := range ids {
+		if id == current {
+			t.Error("current descriptor id is returned")
+		}
+	}
+	if ids, _ := UpcomingDescriptorIDs(pk, now, 0); len(ids) != 0 {
+		t.Error("ids for zero periods")
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	corpus := testCorpus(t, 3)
+	parts := bytes.SplitAfter(corpus, []byte("-----END SIGNATURE-----\n"))
+	parts[1] = bytes.Replace(parts[1], []byte("\nversion 2\n"), []byte("\nversion 9\n"), 1)
+	descs, errs, rest := ParseAll(string(bytes.Join(parts, nil)))
+	if len(descs) != 2 {
+		t.Fatalf("expected 2 descriptors, got %d", len(descs))
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+	derr, ok := errs[0].(*DescriptorError)
+	if !ok || derr.Index != 1 {
+		t.Fatalf("error doesn't identify the descriptor: %v", errs[0])
+	}
+	if _, ok := derr.Err.(ErrUnsupportedVersion); !ok {
+		t.Errorf("unexpected error: %v", derr.Err)
+	}
+	if rest != "" {
+		t.Errorf("unexpected rest: %q", rest)
+	}
+
+	p := &Parser{MaxInputSize: 10}
+	if _, errs, _ := p.ParseAll(string(corpus)); len(errs) != 1 || errs[0] != ErrInputTooLarge {
+		t.Errorf("large input is accepted: %v", errs)
+	}
+}
+
+func TestParseAllLargeInput(t *testing.T) {
+	n := 30
+	corpus := testCorpus(t, n)
+	/* Larger than any single descriptor and than 50 KB caps on input */
+	if len(corpus) <= 50000 {
+		t.Fatalf("corpus of %d bytes is too small", len(corpus))
+	}
+	descs, errs, rest := ParseAll(string(corpus))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(descs) != n {
+		t.Errorf("expected %d descriptors, got %d", n, len(descs))
+	}
+	if rest != "" {
+		t.Errorf("unexpected rest: %q", rest)
+	}
+}
+
+func TestVerifyKeyBinding(t *testing.T) {
+	desc := testDescriptor(t)
+	if err := desc.VerifyKeyBinding(); err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc.PermanentKey = &otherKey.PublicKey
+	if err := desc.Sign(otherKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := desc.VerifySignature(); err != nil {
+		t.Fatal(err)
+	}
+	if err := desc.VerifyKeyBinding(); err != ErrKeyBinding {
+		t.Fatalf("substituted key is not detected: %v", err)
+	}
+}
+
+func TestParseDescriptorID(t *testing.T) {
+	desc := testDescriptor(t)
+	id := desc.DescID
+	if !bytes.Equal(id.Bytes(), id[:]) {
+		t.Error("wrong bytes")
+	}
+	for _, s := range []string{id.String(), id.Hex()} {
+		parsed, err := ParseDescriptorID(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != id {
+			t.Errorf("%s: parsed as %s", s, parsed)
+		}
+	}
+	for _, s := range []string{"", "aaaa", id.String()[:16], id.Hex()[:39] + "x"} {
+		if _, err := ParseDescriptorID(s); err == nil {
+			t.Errorf("%q is parsed", s)
+		}
+	}
+}
+
+func TestParseMixedDirectoryDocument(t *testing.T) {
+	desc := testDescriptor(t)
+	router := "router relay 10.0.0.1 9001 0 80\nplatform Tor 0.2.9.10\n"
+	extraInfo := "extra-info relay 0000000000000000000000000000000000000000\n"
+	data := router + string(desc.Bytes()) + extraInfo + string(desc.Bytes()) + "rendezvous"
+
+	stats := new(ParseStats)
+	l := new(testLogger)
+	p := &Parser{Stats: stats, Logger: l}
+	descs, rest, err := p.ParseOnionDescriptors([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descs) != 2 {
+		t.Fatalf("expected 2 descriptors, got %d", len(descs))
+	}
+	for _, d := range descs {
+		if !bytes.Equal(d.Bytes(), desc.Bytes()) {
+			t.Error("descriptor is not extracted intact")
+		}
+	}
+	if string(rest) != "rendezvous" {
+		t.Errorf("unexpected rest: %q", rest)
+	}
+	if len(*l) != 0 {
+		t.Errorf("skipped documents are logged: %v", *l)
+	}
+	if stats.OK != 2 || stats.Failed != 0 || stats.Skipped != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	p = &Parser{ReportSkipped: true}
+	descs, errs, _ := p.ParseAll(data)
+	if len(descs) != 2 || len(errs) != 2 {
+		t.Fatalf("expected 2 descriptors and 2 errors, got %d and %v", len(descs), errs)
+	}
+	for i, index := range []int{0, 2} {
+		if derr, ok := errs[i].(*DescriptorError); !ok || derr.Index != index || derr.Err != ErrNotOnionDescriptor {
+			t.Errorf("unexpected error: %v", errs[i])
+		}
+	}
+}
+
+func TestDescriptorLifetime(t *testing.T) {
+	sk := testPrivateKey(t)
+	published := time.Unix(1466539200, 0).UTC()
+	desc, err := NewOnionDescriptor(&sk.PublicKey, nil, 0, published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := desc.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	descs, _ := ParseOnionDescriptors(desc.Bytes())
+	if len(descs) != 1 {
+		t.Fatal("descriptor is not parsed")
+	}
+	if descs[0].Lifetime != 0 || !descs[0].ExpiresAt().Equal(published.Add(DefaultDescriptorLifetime)) {
+		t.Errorf("default lifetime is not used: expires at %v", descs[0].ExpiresAt())
+	}
+
+	desc.Lifetime = 3 * time.Hour
+	if err := desc.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(desc.Bytes(), []byte("\ndescriptor-lifetime 180\n")) {
+		t.Fatal("lifetime is not encoded")
+	}
+	descs, _ = ParseOnionDescriptors(desc.Bytes())
+	if len(descs) != 1 || descs[0].Lifetime != desc.Lifetime {
+		t.Fatal("lifetime is not parsed")
+	}
+	if descs[0].IsExpired(published.Add(3*time.Hour - time.Second)) {
+		t.Error("descriptor is expired before its lifetime ends")
+	}
+	if !descs[0].IsExpired(published.Add(3 * time.Hour)) {
+		t.Error("descriptor is not expired after its lifetime")
+	}
+
+	for _, lifetime := range []string{"0", "-5", "1h", "180\ndescriptor-lifetime 180"} {
+		body := bytes.Replace(desc.Bytes(), []byte("descriptor-lifetime 180"), []byte("descriptor-lifetime "+lifetime), 1)
+		_, errs, _ := ParseAll(string(body))
+		if len(errs) != 1 {
+			t.Errorf("%q: lifetime is accepted", lifetime)
+		}
+	}
+}
+
+func TestRawDigest(t *testing.T) {
+	sk := testPrivateKey(t)
+	desc := testDescriptor(t)
+	if _, err := desc.RawDigest(); err == nil {
+		t.Error("built descriptor has raw digest")
+	}
+	/* Produce a descriptor our encoder can't reproduce */
+	body := bytes.Replace(desc.BodyForSigning(), []byte("\nsignature\n"),
+		[]byte("\nnew-shiny-field x\nsignature\n"), 1)
+	sig, err := sk.Sign(rand.Reader, Hash(body), crypto.Hash(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(body, pem.EncodeToMemory(&pem.Block{Type: "SIGNATURE", Bytes: sig})...)
+	descs, _ := ParseOnionDescriptors(append([]byte("@source test\n"), data...))
+	if len(descs) != 1 {
+		t.Fatal("descriptor is not parsed")
+	}
+	parsed := descs[0]
+	if !bytes.Equal(parsed.Raw, data) {
+		t.Fatal("raw bytes are not preserved")
+	}
+	digest, err := parsed.RawDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(digest, Hash(body)) {
+		t.Error("wrong raw digest")
+	}
+	if err := parsed.VerifySignature(); err == nil {
+		t.Error("re-encoded descriptor matches the original")
+	}
+	if err := parsed.VerifyRawSignature(); err != nil {
+		t.Error(err)
+	}
+	parsed.Raw = bytes.Replace(parsed.Raw, []byte("new-shiny-field x"), []byte("new-shiny-field y"), 1)
+	if err := parsed.VerifyRawSignature(); err == nil {
+		t.Error("tampered raw descriptor is verified")
+	}
+}
+
+func TestPresentFields(t *testing.T) {
+	if testDescriptor(t).PresentFields() != nil {
+		t.Error("built descriptor has present fields")
+	}
+	golden, err := ioutil.ReadFile("test/service-descriptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs, _ := ParseOnionDescriptors(golden)
+	if len(descs) != 1 {
+		t.Fatalf("expected 1 descriptor, got %d", len(descs))
+	}
+	expected := []string{
+		"introduction-points",
+		"new-shiny-field",
+		"permanent-key",
+		"protocol-versions",
+		"publication-time",
+		"rendezvous-service-descriptor",
+		"secret-id-part",
+		"signature",
+		"version",
+	}
+	if fields := descs[0].PresentFields(); !reflect.DeepEqual(fields, expected) {
+		t.Errorf("unexpected fields %v", fields)
+	}
+}
+
+func TestEmptyIntroPointsBlock(t *testing.T) {
+	sk := testPrivateKey(t)
+	desc, err := NewOnionDescriptor(&sk.PublicKey, nil, 0, time.Unix(1466539200, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := desc.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	descs, _ := ParseOnionDescriptors(desc.Bytes())
+	if len(descs) != 1 || descs[0].HadIntroPointsBlock {
+		t.Fatal("absent introduction points field is reported as present")
+	}
+
+	desc.HadIntroPointsBlock = true
+	if err := desc.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	empty := desc.Bytes()
+	if !bytes.Contains(empty, []byte("\nintroduction-points\n-----BEGIN MESSAGE-----\n-----END MESSAGE-----\n")) {
+		t.Fatalf("empty block is not encoded:\n%s", empty)
+	}
+	descs, _ = ParseOnionDescriptors(empty)
+	if len(descs) != 1 {
+		t.Fatal("descriptor with empty introduction points block is not parsed")
+	}
+	parsed := descs[0]
+	if !parsed.HadIntroPointsBlock || parsed.AuthType != AuthTypeNone || len(parsed.IntroductionPoints) != 0 {
+		t.Errorf("empty block is parsed incorrectly: %+v", parsed)
+	}
+	if err := parsed.VerifySignature(); err != nil {
+		t.Error(err)
+	}
+
+	noObject := bytes.Replace(empty, []byte("-----BEGIN MESSAGE-----\n-----END MESSAGE-----\n"), nil, 1)
+	if _, errs, _ := ParseAll(string(noObject)); len(errs) != 1 {
+		t.Error("introduction points field without a block is accepted")
+	}
+}
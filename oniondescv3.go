@@ -0,0 +1,262 @@
+// oniondescv3.go - deal with outer layer of v3 onion service descriptors
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nogoegst/onionutil/torparse"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	// DescVersionV3 is the version of v3 onion service descriptors.
+	DescVersionV3 = 3
+	// DescriptorSigPrefixV3 is prepended to the body of v3 descriptor
+	// before signing it.
+	DescriptorSigPrefixV3 = "Tor onion service descriptor sig v3"
+)
+
+const (
+	// CertTypeHSV3DescSigning is the type of certificates of v3
+	// descriptor signing keys.
+	CertTypeHSV3DescSigning = 0x08
+	// CertKeyTypeEd25519 is the type of certified Ed25519 keys.
+	CertKeyTypeEd25519 = 0x01
+	// ExtTypeSignedWithKey is the type of extension holding the key
+	// certificate is signed with.
+	ExtTypeSignedWithKey ExtType = 0x04
+)
+
+// RequiredDescriptorFieldsV3 are fields which must appear exactly once
+// in the outer layer of v3 descriptor.
+var RequiredDescriptorFieldsV3 = []string{
+	"hs-descriptor",
+	"descriptor-lifetime",
+	"descriptor-signing-key-cert",
+	"revision-counter",
+	"superencrypted",
+	"signature",
+}
+
+// OnionDescriptorV3 is the outer (plaintext) layer of v3 onion service
+// descriptor.
+type OnionDescriptorV3 struct {
+	Version  int
+	Lifetime time.Duration
+	// SigningKeyCert is the binary certificate of the descriptor
+	// signing key made by the blinded key.
+	SigningKeyCert  []byte
+	RevisionCounter uint64
+	// Superencrypted is the encrypted middle layer.
+	Superencrypted []byte
+	Signature      []byte
+	// Raw holds the original bytes of a parsed descriptor.
+	Raw []byte
+	// IdentityKey is the public key of the service. It is not part of
+	// the descriptor (only the blinded key is) and is to be set by
+	// the caller which knows the address the descriptor is for.
+	IdentityKey ed25519.PublicKey
+}
+
+// ParseOnionDescriptorV3 parses the outer layer of v3 descriptor.
+func ParseOnionDescriptorV3(data []byte) (*OnionDescriptorV3, error) {
+	docs, _ := torparse.ParseTorDocumentFull(data)
+	if len(docs) == 0 {
+		return nil, errors.New("no document found")
+	}
+	return parseOnionDescriptorV3(docs[0])
+}
+
+func parseOnionDescriptorV3(d torparse.Document) (*OnionDescriptorV3, error) {
+	doc := d.Fields
+	if _, ok := doc["hs-descriptor"]; !ok {
+		return nil, errors.New("not a v3 onion service descriptor")
+	}
+	for _, field := range RequiredDescriptorFieldsV3 {
+		if value, ok := doc[field]; !ok || len(value[0]) == 0 {
+			return nil, ErrMissingField{field}
+		}
+		if !torparse.ExactlyOnce(doc[field]) {
+			return nil, &FieldError{field, ErrDuplicateField}
+		}
+	}
+	desc := &OnionDescriptorV3{Raw: d.Raw}
+
+	version, err := strconv.ParseInt(string(doc["hs-descriptor"].FJoined()), 10, 0)
+	if err != nil {
+		return nil, &FieldError{"hs-descriptor", err}
+	}
+	desc.Version = int(version)
+	if desc.Version != DescVersionV3 {
+		return nil, ErrUnsupportedVersion{desc.Version}
+	}
+
+	minutes, err := strconv.ParseUint(string(doc["descriptor-lifetime"].FJoined()), 10, 32)
+	if err != nil || minutes == 0 {
+		return nil, &FieldError{"descriptor-lifetime",
+			fmt.Errorf("invalid lifetime %q", doc["descriptor-lifetime"].FJoined())}
+	}
+	desc.Lifetime = time.Duration(minutes) * time.Minute
+
+	if objectType := d.ObjectType("descriptor-signing-key-cert"); objectType != "ED25519 CERT" {
+		return nil, &FieldError{"descriptor-signing-key-cert",
+			fmt.Errorf("unexpected certificate object type %q", objectType)}
+	}
+	desc.SigningKeyCert = doc["descriptor-signing-key-cert"].FJoined()
+
+	desc.RevisionCounter, err = strconv.ParseUint(string(doc["revision-counter"].FJoined()), 10, 64)
+	if err != nil {
+		return nil, &FieldError{"revision-counter", err}
+	}
+
+	if objectType := d.ObjectType("superencrypted"); objectType != "MESSAGE" {
+		return nil, &FieldError{"superencrypted",
+			fmt.Errorf("unexpected object type %q", objectType)}
+	}
+	desc.Superencrypted = doc["superencrypted"].FJoined()
+
+	desc.Signature, err = decodeBase64(doc["signature"].FJoined())
+	if err != nil {
+		return nil, &FieldError{"signature", err}
+	}
+	return desc, nil
+}
+
+// SignedBody returns the bytes signature of a parsed descriptor desc
+// is made over: DescriptorSigPrefixV3 followed by the original bytes
+// up to and including the newline before "signature" line.
+func (desc *OnionDescriptorV3) SignedBody() ([]byte, error) {
+	if desc.Raw == nil {
+		return nil, errors.New("descriptor has no raw bytes")
+	}
+	i := bytes.LastIndex(desc.Raw, []byte("\nsignature "))
+	if i < 0 {
+		return nil, errors.New("no signature in raw descriptor")
+	}
+	return append([]byte(DescriptorSigPrefixV3), desc.Raw[:i+1]...), nil
+}
+
+// BlindedKey returns the blinded key the descriptor signing key
+// certificate of desc claims to be signed with. It doesn't verify
+// the certificate.
+func (desc *OnionDescriptorV3) BlindedKey() (ed25519.PublicKey, error) {
+	cert, err := ParseCertFromBytes(desc.SigningKeyCert)
+	if err != nil {
+		return nil, err
+	}
+	ext, ok := cert.Extensions[ExtTypeSignedWithKey]
+	if !ok {
+		return nil, errors.New("certificate has no signing key extension")
+	}
+	if len(ext.Data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("wrong signing key length %d", len(ext.Data))
+	}
+	return ed25519.PublicKey(ext.Data), nil
+}
+
+// VerifyV3Signature verifies that the descriptor signing key certificate
+// of desc is signed with the blinded key it names and that the signature
+// of desc is made with the certified signing key. It doesn't check
+// certificate expiration and whether the blinded key belongs to the
+// expected service (see BlindPublicKey).
+func VerifyV3Signature(desc *OnionDescriptorV3) error {
+	cert, err := ParseCertFromBytes(desc.SigningKeyCert)
+	if err != nil {
+		return &FieldError{"descriptor-signing-key-cert", err}
+	}
+	if cert.Version != 1 {
+		return &FieldError{"descriptor-signing-key-cert",
+			fmt.Errorf("unsupported certificate version %d", cert.Version)}
+	}
+	if cert.CertType != CertTypeHSV3DescSigning || cert.CertKeyType != CertKeyTypeEd25519 {
+		return &FieldError{"descriptor-signing-key-cert",
+			fmt.Errorf("unexpected certificate type %d with key type %d", cert.CertType, cert.CertKeyType)}
+	}
+	blinded, err := desc.BlindedKey()
+	if err != nil {
+		return &FieldError{"descriptor-signing-key-cert", err}
+	}
+	certBody := desc.SigningKeyCert[:len(desc.SigningKeyCert)-Ed25519SignatureSize]
+	if !ed25519.Verify(blinded, certBody, cert.Signature[:]) {
+		return &FieldError{"descriptor-signing-key-cert",
+			errors.New("invalid certificate signature")}
+	}
+	body, err := desc.SignedBody()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(cert.CertifiedKey[:]), body, desc.Signature) {
+		return errors.New("invalid descriptor signature")
+	}
+	return nil
+}
+
+// Address returns onion address of desc derived from IdentityKey.
+func (desc *OnionDescriptorV3) Address() (string, error) {
+	if desc.IdentityKey == nil {
+		return "", errors.New("identity key of v3 descriptor is unknown")
+	}
+	return OnionAddressV3(desc.IdentityKey)
+}
+
+// DescriptorVersion returns desc.Version.
+func (desc *OnionDescriptorV3) DescriptorVersion() int {
+	return desc.Version
+}
+
+// Published returns zero time: v3 descriptors don't carry publication
+// time (see RevisionCounter).
+func (desc *OnionDescriptorV3) Published() time.Time {
+	return time.Time{}
+}
+
+// VerifySignature is the same as VerifyV3Signature(desc).
+func (desc *OnionDescriptorV3) VerifySignature() error {
+	return VerifyV3Signature(desc)
+}
+
+// Verify is the same as VerifySignature.
+func (desc *OnionDescriptorV3) Verify() error {
+	return desc.VerifySignature()
+}
+
+// Body encodes desc. Objects are PEM-encoded and signature is
+// in base64 without padding, as tor does.
+func (desc *OnionDescriptorV3) Body() ([]byte, error) {
+	if len(desc.SigningKeyCert) == 0 {
+		return nil, errors.New("descriptor has no signing key certificate")
+	}
+	w := new(bytes.Buffer)
+	fmt.Fprintf(w, "hs-descriptor %d\n", desc.Version)
+	fmt.Fprintf(w, "descriptor-lifetime %d\n", desc.Lifetime/time.Minute)
+	fmt.Fprintf(w, "descriptor-signing-key-cert\n%s",
+		pem.EncodeToMemory(&pem.Block{Type: "ED25519 CERT", Bytes: desc.SigningKeyCert}))
+	fmt.Fprintf(w, "revision-counter %d\n", desc.RevisionCounter)
+	fmt.Fprintf(w, "superencrypted\n%s",
+		pem.EncodeToMemory(&pem.Block{Type: "MESSAGE", Bytes: desc.Superencrypted}))
+	fmt.Fprintf(w, "signature %s\n", base64.RawStdEncoding.EncodeToString(desc.Signature))
+	return w.Bytes(), nil
+}
+
+// IsExpired reports whether the descriptor signing key certificate
+// of desc is expired at now. Descriptors with invalid certificates
+// are considered expired.
+func (desc *OnionDescriptorV3) IsExpired(now time.Time) bool {
+	cert, err := ParseCertFromBytes(desc.SigningKeyCert)
+	if err != nil {
+		return true
+	}
+	return !now.Before(cert.ExpirationDate)
+}
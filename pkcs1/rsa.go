@@ -83,3 +83,9 @@ func DecodePublicKeyDER(b []byte) (*rsa.PublicKey, []byte, error) {
 	rest, err := asn1.Unmarshal(b, pk)
 	return pk, rest, err
 }
+
+// KeyComponents returns the big-endian modulus of pk without sign
+// padding and its public exponent.
+func KeyComponents(pk *rsa.PublicKey) (modulus []byte, exponent int) {
+	return pk.N.Bytes(), pk.E
+}
@@ -0,0 +1,37 @@
+package pkcs1
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"testing"
+)
+
+func TestKeyComponents(t *testing.T) {
+	sk, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modulus, exponent := KeyComponents(&sk.PublicKey)
+	if len(modulus) != 128 {
+		t.Errorf("unexpected modulus length %d", len(modulus))
+	}
+	if exponent != sk.PublicKey.E {
+		t.Errorf("exponent mismatch: %d != %d", exponent, sk.PublicKey.E)
+	}
+	der, err := EncodePublicKeyDER(&sk.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw struct {
+		N asn1.RawValue
+		E int
+	}
+	if _, err := asn1.Unmarshal(der, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.TrimLeft(raw.N.Bytes, "\x00"), modulus) {
+		t.Errorf("modulus does not match DER encoding")
+	}
+}
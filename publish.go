@@ -0,0 +1,156 @@
+// publish.go - provisioning of complete descriptor sets.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"time"
+)
+
+// NumIntroPoints is the number of introduction points PublishSet
+// selects for a service.
+const NumIntroPoints = 3
+
+// introPointAtRelay makes introduction point candidate at relay described
+// by relay. ServiceKey is left unset.
+func introPointAtRelay(relay Descriptor) (IntroductionPoint, error) {
+	if relay.SigningKey == nil || relay.OnionKey == nil || relay.InternetAddress == nil {
+		return IntroductionPoint{}, fmt.Errorf("relay %s has incomplete descriptor", relay.Nickname)
+	}
+	identity := RelayIdentityDigest(relay.SigningKey)
+	if identity == nil {
+		return IntroductionPoint{}, fmt.Errorf("relay %s has invalid identity key", relay.Nickname)
+	}
+	return IntroductionPoint{
+		Identity:        identity,
+		InternetAddress: relay.InternetAddress,
+		OnionPort:       relay.ORPort,
+		OnionKey:        relay.OnionKey,
+	}, nil
+}
+
+// DescriptorSet is everything needed to publish a service and run it
+// with the published introduction points.
+type DescriptorSet struct {
+	// Descriptors are encoded descriptors of all replicas.
+	Descriptors [][]byte
+	// DescriptorIDs are ids to upload Descriptors to, in the same order.
+	DescriptorIDs []DescriptorID
+	// IntroPoints are the selected introduction points.
+	IntroPoints []IntroductionPoint
+	// ServiceKeys are private keys of ServiceKey of IntroPoints, in the
+	// same order. The service needs them to decrypt INTRODUCE2 cells.
+	ServiceKeys []*rsa.PrivateKey
+}
+
+// PublishSet makes everything needed to publish the service with
+// permanent key priv at now: it selects NumIntroPoints diverse
+// introduction points among relays (in their order), generates service
+// keys for them, builds and signs descriptors for all replicas.
+func PublishSet(priv *rsa.PrivateKey, relays []Descriptor, now time.Time) (*DescriptorSet, error) {
+	var candidates []IntroductionPoint
+	for _, relay := range relays {
+		ip, err := introPointAtRelay(relay)
+		if err != nil {
+			logger.Printf("Skipping relay: %v", err)
+			continue
+		}
+		candidates = append(candidates, ip)
+	}
+	ips, err := SelectIntroPoints(candidates, NumIntroPoints)
+	if err != nil {
+		return nil, err
+	}
+	set := &DescriptorSet{IntroPoints: ips}
+	for i := range ips {
+		sk, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate service key: %v", err)
+		}
+		ips[i].ServiceKey = &sk.PublicKey
+		set.ServiceKeys = append(set.ServiceKeys, sk)
+	}
+	descs, err := BuildReplicaDescriptors(&priv.PublicKey, ips, now)
+	if err != nil {
+		return nil, err
+	}
+	set.Descriptors, err = signDescriptors(descs, priv)
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range descs {
+		set.DescriptorIDs = append(set.DescriptorIDs, desc.DescID)
+	}
+	return set, nil
+}
+
+// MaxPublicationSkew is how far in the future publication time of a v2
+// descriptor may be for HSDirs to accept it (tor's REND_CACHE_MAX_SKEW).
+const MaxPublicationSkew = 24 * time.Hour
+
+// BuildUpcomingDescriptors creates signed descriptors of all replicas of
+// the service with permanent key priv for the time period now is in and
+// periods following ones, so they can be uploaded ahead of rotation.
+// Descriptors of upcoming periods are published at the first full hour
+// of their periods, but no later than MaxPublicationSkew after now:
+// HSDirs reject descriptors from further in the future. Descriptor ids
+// don't depend on publication time, so clamped descriptors still belong
+// to their periods.
+func BuildUpcomingDescriptors(priv *rsa.PrivateKey, ips []IntroductionPoint, now time.Time, periods int) ([]*OnionDescriptor, error) {
+	permID, err := CalcPermanentID(&priv.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	current := CalcTimePeriod(permID, now)
+	latest := NormalizePublicationTime(now.Add(MaxPublicationSkew).Truncate(time.Hour))
+	var descs []*OnionDescriptor
+	for i := 0; i <= periods; i++ {
+		at := now
+		if i > 0 {
+			/* Publication time is truncated to hours, so round up
+			 * to stay within the period */
+			start := timePeriodStart(permID, current+uint32(i))
+			at = start.Truncate(time.Hour)
+			if at.Before(start) {
+				at = at.Add(time.Hour)
+			}
+		}
+		replicas, err := BuildReplicaDescriptors(&priv.PublicKey, ips, at)
+		if err != nil {
+			return nil, err
+		}
+		for _, desc := range replicas {
+			if desc.PublicationTime.After(latest) {
+				desc.PublicationTime = latest
+			}
+		}
+		descs = append(descs, replicas...)
+	}
+	if _, err := signDescriptors(descs, priv); err != nil {
+		return nil, err
+	}
+	return descs, nil
+}
+
+// signDescriptors signs descs with sk and encodes them.
+func signDescriptors(descs []*OnionDescriptor, sk *rsa.PrivateKey) ([][]byte, error) {
+	var bodies [][]byte
+	for _, desc := range descs {
+		if err := desc.Sign(sk); err != nil {
+			return nil, fmt.Errorf("unable to sign descriptor: %v", err)
+		}
+		body, err := desc.Body()
+		if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, body)
+	}
+	return bodies, nil
+}
@@ -0,0 +1,108 @@
+package onionutil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPublishSet(t *testing.T) {
+	sk := testPrivateKey(t)
+	now := time.Unix(1466539200, 0)
+	addrs := []net.IP{
+		net.IPv4(10, 0, 0, 1),
+		net.IPv4(10, 0, 1, 1), // same /16 as the first one
+		nil,                   // incomplete descriptor
+		net.IPv4(10, 1, 0, 1),
+		net.IPv4(10, 2, 0, 1),
+	}
+	var relays []Descriptor
+	for _, addr := range addrs {
+		identityKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		relays = append(relays, Descriptor{
+			Nickname:        "relay",
+			InternetAddress: addr,
+			ORPort:          9001,
+			OnionKey:        &sk.PublicKey,
+			SigningKey:      &identityKey.PublicKey,
+		})
+	}
+
+	set, err := PublishSet(sk, relays, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies, descIDs := set.Descriptors, set.DescriptorIDs
+	if len(set.ServiceKeys) != NumIntroPoints || len(set.IntroPoints) != NumIntroPoints {
+		t.Fatalf("%d service keys for %d introduction points", len(set.ServiceKeys), len(set.IntroPoints))
+	}
+	if len(bodies) != MaxReplica-MinReplica+1 || len(descIDs) != len(bodies) {
+		t.Fatalf("unexpected number of descriptors: %d (%d ids)", len(bodies), len(descIDs))
+	}
+	for i, body := range bodies {
+		descs, _, err := new(Parser).ParseOnionDescriptors(body)
+		if err != nil || len(descs) != 1 {
+			t.Fatalf("descriptor %d is not parsed: %v", i, err)
+		}
+		desc := descs[0]
+		if err := desc.VerifySignature(); err != nil {
+			t.Errorf("descriptor %d: %v", i, err)
+		}
+		if desc.DescID != descIDs[i] {
+			t.Errorf("descriptor %d: id mismatch", i)
+		}
+		ips, _ := ParseIntroPoints(desc.IntropointsBlock)
+		if len(ips) != NumIntroPoints {
+			t.Fatalf("descriptor %d: expected %d introduction points, got %d", i, NumIntroPoints, len(ips))
+		}
+		for j, relay := range []int{0, 3, 4} {
+			if !ips[j].InternetAddress.Equal(addrs[relay]) {
+				t.Errorf("descriptor %d: introduction point %d is at %v", i, j, ips[j].InternetAddress)
+			}
+			if !publicKeysEqual(ips[j].ServiceKey, &set.ServiceKeys[j].PublicKey) {
+				t.Errorf("descriptor %d: service key %d doesn't match the private one", i, j)
+			}
+		}
+	}
+
+	if _, err := PublishSet(sk, relays[:2], now); err == nil {
+		t.Error("no error for insufficient relays")
+	}
+}
+
+func TestBuildUpcomingDescriptors(t *testing.T) {
+	sk := testPrivateKey(t)
+	now := time.Unix(1466539200, 0)
+	descs, err := BuildUpcomingDescriptors(sk, testIntroPoints(t, 3), now, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicas := MaxReplica - MinReplica + 1
+	if len(descs) != 3*replicas {
+		t.Fatalf("expected %d descriptors, got %d", 3*replicas, len(descs))
+	}
+	permID, _ := CalcPermanentID(&sk.PublicKey)
+	current := CalcTimePeriod(permID, now)
+	for i, desc := range descs {
+		period := current + uint32(i/replicas)
+		secretID := CalcSecretIDForPeriod(period, byte(desc.Replica))
+		if !bytes.Equal(desc.SecretIDPart, secretID) || desc.DescID != CalcDescriptorID(permID, secretID) {
+			t.Errorf("descriptor %d: wrong id for period %d", i, period)
+		}
+		latest := now.Add(MaxPublicationSkew)
+		if desc.PublicationTime.After(latest) {
+			t.Errorf("descriptor %d: published too far in the future", i)
+		} else if !desc.PublicationTime.Equal(latest) && CalcTimePeriod(permID, desc.PublicationTime) != period {
+			t.Errorf("descriptor %d: published in a wrong period", i)
+		}
+		if err := desc.VerifySignature(); err != nil {
+			t.Errorf("descriptor %d: %v", i, err)
+		}
+	}
+}
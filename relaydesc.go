@@ -10,7 +10,6 @@ package onionutil
 import (
 	"crypto/rsa"
 	"encoding/base64"
-	"log"
 	"net"
 	"reflect"
 	"strconv"
@@ -64,7 +63,7 @@ func ParseServerDescriptors(descs_str []byte) (descs []Descriptor, rest string)
 	for _, doc := range docs {
 		var desc Descriptor
 		if string(doc["@type"].FJoined()) != documentType {
-			log.Printf("Got a document that is not \"%s\"", documentType)
+			logger.Printf("Got a document that is not \"%s\"", documentType)
 			continue
 		}
 		if value, ok := doc["router"]; ok {
@@ -151,7 +150,7 @@ func ParseServerDescriptors(descs_str []byte) (descs []Descriptor, rest string)
 			}
 			platform, err := ParsePlatformEntry(value[0])
 			if err != nil {
-				log.Printf("platerr: %v", err)
+				logger.Printf("platerr: %v", err)
 				goto Broken
 			}
 			desc.Platform = platform
@@ -419,7 +418,7 @@ func ParseServerDescriptors(descs_str []byte) (descs []Descriptor, rest string)
 		descs = append(descs, desc)
 		continue
 	Broken:
-		log.Printf("-broken-")
+		logger.Printf("-broken-")
 		// if saveBroken ...
 		continue
 	}
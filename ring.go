@@ -0,0 +1,130 @@
+// ring.go - placement of v2 descriptors on the HSDir hash ring
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/binary"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// NumResponsibleHSDirs is the number of consecutive HSDirs on the ring
+// responsible for a descriptor id (REND_NUMBER_OF_CONSECUTIVE_REPLICAS).
+const NumResponsibleHSDirs = 3
+
+// HSDirNode is a relay serving as v2 onion service directory.
+type HSDirNode struct {
+	Nickname string
+	// Identity is relay identity digest, its position on the ring.
+	Identity []byte
+	// Address is host:port of relay DirPort.
+	Address string
+}
+
+// HSDirRing is a hash ring of HSDirs ordered by their identities.
+type HSDirRing []HSDirNode
+
+// NewHSDirRing makes a ring of nodes.
+func NewHSDirRing(nodes []HSDirNode) HSDirRing {
+	ring := append(HSDirRing{}, nodes...)
+	sort.Slice(ring, func(i, j int) bool {
+		return bytes.Compare(ring[i].Identity, ring[j].Identity) < 0
+	})
+	return ring
+}
+
+// HSDirRingFromDescriptors makes a ring of relays from their server
+// descriptors, taking only those serving v2 onion service directories.
+func HSDirRingFromDescriptors(descs []Descriptor) HSDirRing {
+	var nodes []HSDirNode
+	for _, desc := range descs {
+		isHSDir := false
+		for _, v := range desc.HSDirVersions {
+			isHSDir = isHSDir || v == 2
+		}
+		if !isHSDir || desc.SigningKey == nil || desc.DirPort == 0 {
+			continue
+		}
+		identity := RelayIdentityDigest(desc.SigningKey)
+		if identity == nil {
+			continue
+		}
+		nodes = append(nodes, HSDirNode{
+			Nickname: desc.Nickname,
+			Identity: identity,
+			Address:  net.JoinHostPort(desc.InternetAddress.String(), strconv.Itoa(int(desc.DirPort))),
+		})
+	}
+	return NewHSDirRing(nodes)
+}
+
+// position returns index of the first node on the ring with identity
+// not less than id, i.e. where id lands on the ring.
+func (ring HSDirRing) position(id []byte) int {
+	i := sort.Search(len(ring), func(i int) bool {
+		return bytes.Compare(ring[i].Identity, id) >= 0
+	})
+	if i == len(ring) {
+		i = 0 /* Wrap around */
+	}
+	return i
+}
+
+// ResponsibleHSDirs returns HSDirs responsible for descriptor id descID:
+// NumResponsibleHSDirs nodes following descID on the ring.
+func (ring HSDirRing) ResponsibleHSDirs(descID DescriptorID) []HSDirNode {
+	var nodes []HSDirNode
+	start := ring.position(descID[:])
+	for i := 0; i < len(ring) && i < NumResponsibleHSDirs; i++ {
+		nodes = append(nodes, ring[(start+i)%len(ring)])
+	}
+	return nodes
+}
+
+// ResponsibleHSDirs returns HSDirs on ring responsible for desc, i.e.
+// the ones it should be published to and fetched from.
+func (desc OnionDescriptor) ResponsibleHSDirs(ring HSDirRing) []HSDirNode {
+	return ring.ResponsibleHSDirs(desc.DescID)
+}
+
+// ReplicaPlacement describes where descriptor of a replica lands on the
+// ring.
+type ReplicaPlacement struct {
+	Replica int
+	DescID  DescriptorID
+	// Position is index of the first responsible node in the ring.
+	Position int
+	// Fraction is the position of DescID on the ring in [0, 1).
+	Fraction    float64
+	Responsible []HSDirNode
+}
+
+// PlacementReport reports placement of descriptors of all replicas of the
+// service with permanent key pk at now on ring.
+func PlacementReport(pk *rsa.PublicKey, ring HSDirRing, now time.Time) ([]ReplicaPlacement, error) {
+	var report []ReplicaPlacement
+	for replica := MinReplica; replica <= MaxReplica; replica++ {
+		descID, err := CalcDescriptorIDByKey(pk, now, byte(replica))
+		if err != nil {
+			return nil, err
+		}
+		report = append(report, ReplicaPlacement{
+			Replica:     replica,
+			DescID:      descID,
+			Position:    ring.position(descID[:]),
+			Fraction:    float64(binary.BigEndian.Uint64(descID[:])) / math.Pow(2, 64),
+			Responsible: ring.ResponsibleHSDirs(descID),
+		})
+	}
+	return report, nil
+}
@@ -0,0 +1,159 @@
+package onionutil
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testRing(n int) HSDirRing {
+	var nodes []HSDirNode
+	for i := n - 1; i >= 0; i-- {
+		identity := make([]byte, IdentityLength)
+		identity[0] = byte(i * 256 / n)
+		nodes = append(nodes, HSDirNode{Identity: identity})
+	}
+	return NewHSDirRing(nodes)
+}
+
+func TestResponsibleHSDirs(t *testing.T) {
+	ring := testRing(8) // Identities start with 0x00, 0x20, ..., 0xe0
+	for i := 1; i < len(ring); i++ {
+		if bytes.Compare(ring[i-1].Identity, ring[i].Identity) >= 0 {
+			t.Fatal("ring is not sorted")
+		}
+	}
+	for _, tc := range []struct {
+		descID byte
+		first  []byte
+	}{
+		{0x00, []byte{0x00, 0x20, 0x40}},
+		{0x01, []byte{0x20, 0x40, 0x60}},
+		{0x20, []byte{0x20, 0x40, 0x60}},
+		{0xc1, []byte{0xe0, 0x00, 0x20}},
+		{0xe1, []byte{0x00, 0x20, 0x40}},
+	} {
+		var descID DescriptorID
+		descID[0] = tc.descID
+		if tc.descID == 0x20 {
+			copy(descID[:], ring[1].Identity)
+		}
+		nodes := ring.ResponsibleHSDirs(descID)
+		if len(nodes) != NumResponsibleHSDirs {
+			t.Fatalf("%x: %d responsible HSDirs", tc.descID, len(nodes))
+		}
+		for i, node := range nodes {
+			if node.Identity[0] != tc.first[i] {
+				t.Errorf("%x: wrong HSDir %d: %x", tc.descID, i, node.Identity)
+			}
+		}
+	}
+	if nodes := testRing(2).ResponsibleHSDirs(DescriptorID{}); len(nodes) != 2 {
+		t.Errorf("small ring: %d responsible HSDirs", len(nodes))
+	}
+	if nodes := HSDirRing(nil).ResponsibleHSDirs(DescriptorID{}); nodes != nil {
+		t.Errorf("empty ring has responsible HSDirs")
+	}
+}
+
+func TestResponsibleHSDirsOfRelays(t *testing.T) {
+	// Identity fingerprints of directory authorities as listed in tor's
+	// src/app/config/auth_dirs.inc.
+	var nodes []HSDirNode
+	for _, relay := range []struct{ nickname, fingerprint string }{
+		{"moria1", "9695DFC35FFEB861329B9F1AB04C46397020CE31"},
+		{"tor26", "847B1F850344D7876491A54892F904934E4EB85D"},
+		{"dizum", "7EA6EAD6FD83083C538F44038BBFA077587DD755"},
+		{"gabelmoo", "F2044413DAC2E02E3D6BCF4735A19BCA1DE97281"},
+	} {
+		nodes = append(nodes, HSDirNode{Nickname: relay.nickname, Identity: mustDecodeHex(relay.fingerprint)})
+	}
+	ring := NewHSDirRing(nodes)
+	for _, tc := range []struct {
+		descID      string
+		responsible []string
+	}{
+		// Descriptor id of test/descriptors/hartwellnogoegst
+		// (F208398B...) follows gabelmoo and wraps around.
+		{"6iedtc4w36h35ln3ntklmbiawjhgdjud", []string{"dizum", "tor26", "moria1"}},
+		{"8000000000000000000000000000000000000000", []string{"tor26", "moria1", "gabelmoo"}},
+		// Identity of moria1 itself.
+		{"9695DFC35FFEB861329B9F1AB04C46397020CE31", []string{"moria1", "gabelmoo", "dizum"}},
+	} {
+		descID, err := ParseDescriptorID(tc.descID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var responsible []string
+		for _, node := range ring.ResponsibleHSDirs(descID) {
+			responsible = append(responsible, node.Nickname)
+		}
+		if !reflect.DeepEqual(responsible, tc.responsible) {
+			t.Errorf("%s: responsible HSDirs are %v instead of %v", tc.descID, responsible, tc.responsible)
+		}
+	}
+}
+
+func TestPlacementReport(t *testing.T) {
+	pk := &testPrivateKey(t).PublicKey
+	now := time.Unix(1466539200, 0)
+	ring := testRing(16)
+	report, err := PlacementReport(pk, ring, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != MaxReplica-MinReplica+1 {
+		t.Fatalf("unexpected report length %d", len(report))
+	}
+	for _, p := range report {
+		descID, _ := CalcDescriptorIDByKey(pk, now, byte(p.Replica))
+		if p.DescID != descID {
+			t.Errorf("replica %d: wrong descriptor id", p.Replica)
+		}
+		if p.Fraction < 0 || p.Fraction >= 1 || int(p.Fraction*16+1)%16 != p.Position {
+			t.Errorf("replica %d: inconsistent position %d (%f)", p.Replica, p.Position, p.Fraction)
+		}
+		if !bytes.Equal(p.Responsible[0].Identity, ring[p.Position].Identity) {
+			t.Errorf("replica %d: wrong responsible HSDirs", p.Replica)
+		}
+	}
+}
+
+func TestHSDirRingFromDescriptors(t *testing.T) {
+	pk := &testPrivateKey(t).PublicKey
+	descs := []Descriptor{
+		{Nickname: "hsdir", InternetAddress: net.IPv4(10, 0, 0, 1), DirPort: 80, SigningKey: pk, HSDirVersions: []uint8{2}},
+		{Nickname: "nodir", InternetAddress: net.IPv4(10, 0, 0, 2), DirPort: 80, SigningKey: pk},
+		{Nickname: "noport", InternetAddress: net.IPv4(10, 0, 0, 3), SigningKey: pk, HSDirVersions: []uint8{2}},
+	}
+	ring := HSDirRingFromDescriptors(descs)
+	if len(ring) != 1 || ring[0].Nickname != "hsdir" || ring[0].Address != "10.0.0.1:80" {
+		t.Fatalf("unexpected ring %+v", ring)
+	}
+	identity, _ := RSAPubkeyHash(pk)
+	if !bytes.Equal(ring[0].Identity, identity) {
+		t.Error("wrong identity")
+	}
+}
+
+func TestDescriptorResponsibleHSDirs(t *testing.T) {
+	ring := testRing(16)
+	desc := testDescriptor(t)
+	nodes := desc.ResponsibleHSDirs(ring)
+	if !reflect.DeepEqual(nodes, ring.ResponsibleHSDirs(desc.DescID)) {
+		t.Error("responsible HSDirs differ from the ones of descriptor id")
+	}
+	following := 0
+	for _, node := range ring {
+		if bytes.Compare(node.Identity, desc.DescID[:]) >= 0 {
+			following++
+		}
+	}
+	for _, node := range nodes {
+		if bytes.Compare(node.Identity, desc.DescID[:]) < 0 && following >= NumResponsibleHSDirs {
+			t.Errorf("HSDir %x precedes descriptor id %x", node.Identity, desc.DescID)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// servicedesc.go - version-agnostic onion service descriptors
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"time"
+
+	"github.com/nogoegst/onionutil/torparse"
+)
+
+// ServiceDescriptor is an onion service descriptor of any version.
+// It is implemented by *OnionDescriptor (v2) and *OnionDescriptorV3.
+// (Descriptor is taken by relay server descriptors.) Version and
+// publication time are exposed as DescriptorVersion and Published
+// since the concrete types have fields with the plain names.
+type ServiceDescriptor interface {
+	// DescriptorVersion returns version of the descriptor format.
+	DescriptorVersion() int
+	// Published returns publication time of the descriptor or zero
+	// time if the format doesn't carry it.
+	Published() time.Time
+	// Address returns onion address of the service the descriptor
+	// belongs to without ".onion" suffix.
+	Address() (string, error)
+	// VerifySignature verifies signature of the descriptor only.
+	VerifySignature() error
+	// Verify verifies signatures of the descriptor and everything
+	// else that can be checked without external information.
+	Verify() error
+	// Body encodes the descriptor.
+	Body() ([]byte, error)
+	// IsExpired reports whether the descriptor is expired at now.
+	IsExpired(now time.Time) bool
+}
+
+var (
+	_ ServiceDescriptor = (*OnionDescriptor)(nil)
+	_ ServiceDescriptor = (*OnionDescriptorV3)(nil)
+)
+
+// ParseServiceDescriptors parses v2 and v3 onion service descriptors
+// in data. Other documents are skipped. Descriptors that fail to parse
+// are reported in errs as *DescriptorError.
+func ParseServiceDescriptors(data []byte) (descs []ServiceDescriptor, errs []error, rest []byte) {
+	return new(Parser).ParseServiceDescriptors(data)
+}
+
+// ParseServiceDescriptors is like the package-level ParseServiceDescriptors
+// but uses the options of p. If data is larger than p.MaxInputSize, errs
+// holds only ErrInputTooLarge.
+func (p *Parser) ParseServiceDescriptors(data []byte) (descs []ServiceDescriptor, errs []error, rest []byte) {
+	if p.inputTooLarge(len(data)) {
+		return nil, []error{ErrInputTooLarge}, data
+	}
+	docs, rest := torparse.ParseMixedDocumentsFull(data)
+	for i, doc := range docs {
+		var desc ServiceDescriptor
+		var err error
+		switch {
+		case doc.Fields["rendezvous-service-descriptor"] != nil:
+			var v2 OnionDescriptor
+			v2, err = p.parseOnionDescriptor(doc)
+			desc = &v2
+		case doc.Fields["hs-descriptor"] != nil:
+			if limit := p.descriptorSizeLimit(); limit >= 0 && len(doc.Raw) > limit {
+				err = ErrDescriptorTooLarge
+				break
+			}
+			desc, err = parseOnionDescriptorV3(doc)
+		default:
+			if !p.ReportSkipped {
+				if p.Stats != nil {
+					p.Stats.Skipped++
+				}
+				continue
+			}
+			err = ErrNotOnionDescriptor
+		}
+		if p.Stats != nil {
+			p.Stats.add(err)
+		}
+		if err != nil {
+			errs = append(errs, &DescriptorError{Index: i, Err: err})
+			continue
+		}
+		descs = append(descs, desc)
+	}
+	return descs, errs, rest
+}
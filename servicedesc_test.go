@@ -0,0 +1,134 @@
+package onionutil
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestServiceDescriptor(t *testing.T) {
+	v2 := testDescriptor(t)
+	parsed, _ := ParseOnionDescriptors(v2.Bytes())
+	if len(parsed) != 1 {
+		t.Fatalf("parsed %d descriptors instead of 1", len(parsed))
+	}
+	v3Data, _ := testDescriptorV3(t)
+	v3, err := ParseOnionDescriptorV3(v3Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v3.Address(); err == nil {
+		t.Error("address of v3 descriptor with unknown identity key")
+	}
+	identity, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v3.IdentityKey = identity
+
+	v2Address, err := OnionAddressV2(v2.PermanentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v3Address, err := OnionAddressV3(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		desc      ServiceDescriptor
+		version   int
+		published time.Time
+		address   string
+		expires   time.Time
+	}{
+		{v2, 2, v2.PublicationTime, v2Address, v2.ExpiresAt()},
+		{&parsed[0], 2, v2.PublicationTime, v2Address, v2.ExpiresAt()},
+		{v3, 3, time.Time{}, v3Address, time.Unix(500000*3600, 0)},
+	} {
+		if tc.desc.DescriptorVersion() != tc.version {
+			t.Errorf("expected version %d, got %d", tc.version, tc.desc.DescriptorVersion())
+		}
+		if !tc.desc.Published().Equal(tc.published) {
+			t.Errorf("expected publication time %v, got %v", tc.published, tc.desc.Published())
+		}
+		if err := tc.desc.VerifySignature(); err != nil {
+			t.Errorf("version %d: %v", tc.version, err)
+		}
+		address, err := tc.desc.Address()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if address != tc.address {
+			t.Errorf("expected address %s, got %s", tc.address, address)
+		}
+		if err := tc.desc.Verify(); err != nil {
+			t.Errorf("%s: %v", address, err)
+		}
+		if tc.desc.IsExpired(tc.expires.Add(-time.Second)) || !tc.desc.IsExpired(tc.expires) {
+			t.Errorf("%s: wrong expiration", address)
+		}
+	}
+
+	v2.SecretIDPart = []byte("12345678901234567890")
+	if err := v2.Verify(); err == nil {
+		t.Error("tampered v2 descriptor is verified")
+	}
+}
+
+func TestOnionDescriptorV3Body(t *testing.T) {
+	data, _ := testDescriptorV3(t)
+	desc, err := ParseOnionDescriptorV3(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := desc.Body()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, data) {
+		t.Errorf("expected\n%s\ngot\n%s", data, body)
+	}
+}
+
+func TestParseServiceDescriptors(t *testing.T) {
+	v2Data := testDescriptor(t).Bytes()
+	v3Data, _ := testDescriptorV3(t)
+	data := bytes.Join([][]byte{
+		v3Data,
+		v2Data,
+		[]byte("router test 127.0.0.1 9001 0 0\n"),
+		[]byte("hs-descriptor 3\n"),
+		v2Data,
+	}, nil)
+	descs, errs, _ := ParseServiceDescriptors(data)
+	if len(descs) != 3 {
+		t.Fatalf("parsed %d descriptors instead of 3", len(descs))
+	}
+	for i, version := range []int{3, 2, 2} {
+		if descs[i].DescriptorVersion() != version {
+			t.Errorf("descriptor %d has version %d instead of %d", i, descs[i].DescriptorVersion(), version)
+		}
+		if err := descs[i].Verify(); err != nil {
+			t.Errorf("descriptor %d: %v", i, err)
+		}
+	}
+	if len(errs) != 1 || errs[0].(*DescriptorError).Index != 3 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+
+	stats := new(ParseStats)
+	p := &Parser{AllowedProtocolVersions: []int{3}, Stats: stats}
+	descs, errs, _ = p.ParseServiceDescriptors(data)
+	if len(descs) != 1 || descs[0].DescriptorVersion() != 3 {
+		t.Errorf("v2 descriptors are parsed ignoring parser options")
+	}
+	if len(errs) != 3 || stats.Failed != 3 || stats.Skipped != 1 {
+		t.Errorf("unexpected errors %v with statistics %+v", errs, stats)
+	}
+	p = &Parser{DescriptorSizeLimit: 100}
+	if descs, errs, _ = p.ParseServiceDescriptors(data); len(descs) != 0 || len(errs) != 4 {
+		t.Errorf("descriptor size limit is ignored: %v", errs)
+	}
+}
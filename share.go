@@ -0,0 +1,60 @@
+// share.go - compact strings for sharing access to onion services
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// shareCookieParam is the query parameter holding descriptor cookie
+// in share strings.
+const shareCookieParam = "cookie"
+
+// ShareString encodes onion address address and, unless cookie is empty,
+// client authorization cookie (as returned by EncodeDescriptorCookie)
+// into a compact string suitable for QR codes and links:
+// "address.onion" or "address.onion?cookie=...". This format is used
+// by some apps for sharing and has nothing to do with tor's wire formats.
+func ShareString(address, cookie string) string {
+	s := NormalizeOnionAddress(address) + ".onion"
+	if cookie != "" {
+		s += "?" + url.Values{shareCookieParam: {cookie}}.Encode()
+	}
+	return s
+}
+
+// ParseShareString parses share string s as produced by ShareString.
+// It returns address without ".onion" suffix and cookie, which is empty
+// if s doesn't carry one.
+func ParseShareString(s string) (address, cookie string, err error) {
+	s = strings.TrimSpace(s)
+	query := ""
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		s, query = s[:i], s[i+1:]
+	}
+	address, ok := StripOnionTLD(s)
+	if !ok {
+		return "", "", fmt.Errorf("%q is not an onion address", s)
+	}
+	if !OnionAddressIsValid(address) {
+		return "", "", fmt.Errorf("invalid onion address %q", address)
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid share string parameters: %v", err)
+	}
+	cookie = values.Get(shareCookieParam)
+	if cookie != "" {
+		if _, _, err := ParseDescriptorCookie(cookie); err != nil {
+			return "", "", err
+		}
+	}
+	return address, cookie, nil
+}
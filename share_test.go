@@ -0,0 +1,43 @@
+package onionutil
+
+import (
+	"testing"
+)
+
+func TestShareString(t *testing.T) {
+	_, cookie, err := GenerateDescriptorCookie(AuthTypeBasic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		address, cookie, share string
+	}{
+		{"hartwellnogoegst", "", "hartwellnogoegst.onion"},
+		{" HartwellNogoegst.onion ", "", "hartwellnogoegst.onion"},
+		{"hartwellnogoegst", cookie, ""},
+	} {
+		share := ShareString(tc.address, tc.cookie)
+		if tc.share != "" && share != tc.share {
+			t.Errorf("%s: expected %q, got %q", tc.address, tc.share, share)
+		}
+		address, parsedCookie, err := ParseShareString(share)
+		if err != nil {
+			t.Fatalf("%s: %v", share, err)
+		}
+		if address != "hartwellnogoegst" || parsedCookie != tc.cookie {
+			t.Errorf("%s: parsed as %q, %q", share, address, parsedCookie)
+		}
+	}
+
+	for _, s := range []string{
+		"hartwellnogoegst",
+		"example.com",
+		"invalid.onion",
+		"hartwellnogoegst.onion?cookie=invalid",
+		"hartwellnogoegst.onion?cookie=%zz",
+	} {
+		if _, _, err := ParseShareString(s); err == nil {
+			t.Errorf("%q is parsed", s)
+		}
+	}
+}
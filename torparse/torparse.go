@@ -10,7 +10,11 @@ package torparse
 import (
 	"bytes"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
 )
 
 type TorEntry [][]byte
@@ -41,19 +45,73 @@ func (entries TorEntries) FJoined() (joined []byte) {
 	return entries[0].Joined()
 }
 
+// AllJoined returns joined contents of all entries in order of their
+// appearance. Use it for keywords that may legitimately repeat (like
+// "or-address") as FJoined returns only the first one.
+func (entries TorEntries) AllJoined() (joined [][]byte) {
+	for _, entry := range entries {
+		joined = append(joined, entry.Joined())
+	}
+	return joined
+}
+
+// Values returns joined contents of all occurrences of field in doc in
+// order of their appearance. It returns nil if there is no such field.
+func (doc TorDocument) Values(field string) [][]byte {
+	return doc[field].AllJoined()
+}
+
+// Document is a parsed Tor document together with information about
+// it that doesn't fit into TorDocument.
+type Document struct {
+	Fields TorDocument
+	// Raw holds the original bytes the document was parsed from,
+	// starting with its first keyword and ending after its last field.
+	// Preceding annotations are not included.
+	Raw []byte
+	// ObjectTypes maps keywords to types of objects (PEM block labels
+	// like "SIGNATURE") following their first occurrences.
+	ObjectTypes map[string]string
+}
+
+// ObjectType returns type of the object of the first occurrence of
+// field in doc or "" if it has no object.
+func (doc Document) ObjectType(field string) string {
+	return doc.ObjectTypes[field]
+}
+
+// Keywords returns sorted keywords of fields present in doc. Annotations
+// are not included.
+func (doc TorDocument) Keywords() (keywords []string) {
+	for key := range doc {
+		if IsAnnotation(key) {
+			continue
+		}
+		keywords = append(keywords, key)
+	}
+	sort.Strings(keywords)
+	return keywords
+}
 
 func ParseOutNextField(data []byte) (field string, content TorEntry, rest []byte, err error) {
+	field, content, _, rest, err = ParseOutNextObject(data)
+	return field, content, rest, err
+}
+
+// ParseOutNextObject is like ParseOutNextField but also returns type of
+// the object following the keyword line or "" if there is none.
+func ParseOutNextObject(data []byte) (field string, content TorEntry, objectType string, rest []byte, err error) {
 	pemStart := []byte("-----BEGIN ")
 	nl_split := bytes.SplitN(data, []byte("\n"), 2)
 	if len(nl_split) != 2 {
-		return field, content, data,
+		return field, content, "", data,
 			fmt.Errorf("Cannot split by newline")
 	}
 	/* Overwrite with the rest */
 	rest = nl_split[1]
 	sp_split := bytes.SplitN(nl_split[0], []byte(" "), -1)
 	if len(sp_split) <= 0 { /* We have no data left */
-		return field, content, data,
+		return field, content, "", data,
 			fmt.Errorf("No data left")
 	}
 
@@ -61,41 +119,206 @@ func ParseOutNextField(data []byte) (field string, content TorEntry, rest []byte
 	content = sp_split[1:]
 	/* test if we have pem data now. if so append to previous field */
 	if bytes.HasPrefix(rest, pemStart) {
-		block, pem_rest := pem.Decode(data)
+		block, pem_rest := pem.Decode(rest)
+		if block == nil {
+			return field, content, "", data,
+				fmt.Errorf("Malformed PEM block in field %s", field)
+		}
 		content = append(content, block.Bytes)
+		objectType = block.Type
 		rest = pem_rest
 	}
-	return field, content, rest, err
+	return field, content, objectType, rest, err
+}
+
+// SniffLength is the number of leading bytes CheckDocument inspects.
+const SniffLength = 512
+
+var ErrNotDocument = errors.New("Data doesn't look like a Tor document")
+
+func isKeywordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		c >= '0' && c <= '9' || c == '-'
 }
 
+// trimPartialRune trims an incomplete UTF-8 sequence at the end of b.
+func trimPartialRune(b []byte) []byte {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if !utf8.FullRune(b[len(b)-i:]) {
+				return b[:len(b)-i]
+			}
+			break
+		}
+	}
+	return b
+}
+
+// CheckDocument cheaply checks whether data looks like a Tor document:
+// its first SniffLength bytes must be valid UTF-8 without control
+// characters other than whitespace, and the first non-blank line must
+// be a complete keyword line. It returns ErrNotDocument otherwise.
+func CheckDocument(data []byte) error {
+	sniff := data
+	if len(sniff) > SniffLength {
+		sniff = trimPartialRune(sniff[:SniffLength])
+	}
+	if !utf8.Valid(sniff) {
+		return ErrNotDocument
+	}
+	for _, r := range string(sniff) {
+		if (r < 0x20 && r != '\n' && r != '\r' && r != '\t') || r == 0x7f {
+			return ErrNotDocument
+		}
+	}
+	var line []byte
+	for {
+		nl := bytes.IndexByte(sniff, '\n')
+		if nl < 0 {
+			return ErrNotDocument
+		}
+		line = bytes.TrimSuffix(sniff[:nl], []byte("\r"))
+		sniff = sniff[nl+1:]
+		if len(line) > 0 {
+			break
+		}
+	}
+	if line[0] == '@' { /* Annotation */
+		line = line[1:]
+	}
+	i := 0
+	for i < len(line) && isKeywordChar(line[i]) {
+		i++
+	}
+	if i == 0 || (i < len(line) && line[i] != ' ' && line[i] != '\t') {
+		return ErrNotDocument
+	}
+	return nil
+}
+
+// IsAnnotation reports whether field is an annotation (like
+// "@downloaded-at" or "@source") rather than a document keyword.
+// Annotations are attached to the document that follows them.
+func IsAnnotation(field string) bool {
+	return strings.HasPrefix(field, "@")
+}
+
+// ParseTorDocument parses all documents in doc_data. Documents are
+// delimited by the keyword of the first one. rest holds data that
+// can't be parsed, e.g. an incomplete trailing line. Data that doesn't
+// pass CheckDocument is not parsed at all. Only fields of documents are
+// returned, use ParseTorDocumentFull to get their raw bytes and object
+// types as well.
 // TODO: trim/skip empty strings/separators
 func ParseTorDocument(doc_data []byte) (docs []TorDocument, rest []byte) {
-	var doc TorDocument
+	return fieldsOf(ParseTorDocumentFull(doc_data))
+}
+
+// ParseTorDocumentFull is like ParseTorDocument but returns Documents
+// carrying raw bytes and object types along with fields.
+func ParseTorDocumentFull(data []byte) (docs []Document, rest []byte) {
+	return parseTorDocument(data, nil)
+}
+
+// DocumentKeywords are keywords that start known Tor documents.
+var DocumentKeywords = []string{
+	"router",
+	"extra-info",
+	"rendezvous-service-descriptor",
+	"network-status-version",
+	"dir-key-certificate-version",
+	"hs-descriptor",
+}
+
+// ParseMixedDocuments is like ParseTorDocument but for data holding
+// documents of different types: besides the keyword of the first
+// document, any of DocumentKeywords starts a new document. Use
+// ParseMixedDocumentsFull to get Documents instead of fields only.
+func ParseMixedDocuments(doc_data []byte) (docs []TorDocument, rest []byte) {
+	return fieldsOf(ParseMixedDocumentsFull(doc_data))
+}
+
+// ParseMixedDocumentsFull is like ParseMixedDocuments but returns
+// Documents carrying raw bytes and object types along with fields.
+func ParseMixedDocumentsFull(data []byte) (docs []Document, rest []byte) {
+	starts := make(map[string]bool)
+	for _, keyword := range DocumentKeywords {
+		starts[keyword] = true
+	}
+	return parseTorDocument(data, starts)
+}
+
+func fieldsOf(docs []Document, rest []byte) ([]TorDocument, []byte) {
+	var fields []TorDocument
+	for _, doc := range docs {
+		fields = append(fields, doc.Fields)
+	}
+	return fields, rest
+}
+
+func parseTorDocument(doc_data []byte, starts map[string]bool) (docs []Document, rest []byte) {
+	if CheckDocument(doc_data) != nil { /* Fail fast on garbage */
+		return nil, doc_data
+	}
+	var doc Document
 	var field string
 	var content TorEntry
+	var objectType string
 	var firstField string
 
+	/* Offsets of the current doc in the original data */
+	orig := doc_data
+	var docStart, docEnd int
+
+	/* Annotations preceding a document */
+	var annotations TorDocument
+
 	var parse_err error
 	for {
-		field, content, doc_data, parse_err = ParseOutNextField(doc_data)
+		pos := len(orig) - len(doc_data)
+		field, content, objectType, doc_data, parse_err = ParseOutNextObject(doc_data)
 		//log.Printf("parsed: %v : %v", field, content)
 		if parse_err != nil {
 			//log.Printf("Error parsing document: %v", parse_err)
 			break
 		}
+		if field == "" { /* Skip empty lines */
+			continue
+		}
+		if IsAnnotation(field) {
+			if annotations == nil {
+				annotations = make(TorDocument)
+			}
+			annotations[field] = append(annotations[field], content)
+			continue
+		}
 		if firstField == "" { /* We're just in the begining - doc name */
 			firstField = field
 		}
-		if field == firstField {
-			if doc != nil {
+		if field == firstField || starts[field] {
+			if doc.Fields != nil {
 				/* Append previous doc */
+				doc.Raw = orig[docStart:docEnd]
 				docs = append(docs, doc)
 			}
-			doc = make(TorDocument)
+			doc = Document{
+				Fields:      make(TorDocument),
+				ObjectTypes: make(map[string]string),
+			}
+			docStart = pos
+			for key, value := range annotations {
+				doc.Fields[key] = value
+			}
+			annotations = nil
+		}
+		doc.Fields[field] = append(doc.Fields[field], content)
+		if objectType != "" && len(doc.Fields[field]) == 1 {
+			doc.ObjectTypes[field] = objectType
 		}
-		doc[field] = append(doc[field], content)
+		docEnd = len(orig) - len(doc_data)
 	}
-	if doc != nil {
+	if doc.Fields != nil {
+		doc.Raw = orig[docStart:docEnd]
 		docs = append(docs, doc) /* Append a doc */
 	}
 
@@ -4,7 +4,9 @@ import (
 	"testing"
 	"io/ioutil"
 	"reflect"
+	"strings"
 	"encoding/hex"
+	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
 )
@@ -18,11 +20,11 @@ func TestParseTorDocument(t *testing.T) {
 func testServiceDescriptor(t *testing.T) {
 	servicedesc, err := ioutil.ReadFile("../test/service-descriptor")
 	if err != nil {
-		t.Error("Unable to find open a file: %v", err)
+		t.Fatalf("Unable to find open a file: %v", err)
 	}
 	parsed, rest := ParseTorDocument(servicedesc)
 	if len(rest) > 0 {
-		t.Error("Some fields left unparsed: '%v'", rest)
+		t.Errorf("Some fields left unparsed: '%v'", rest)
 	}
 	if len(parsed) != 1 {
 		t.Error("There is not exactly one descriptor")
@@ -51,10 +53,10 @@ func testServiceDescriptor(t *testing.T) {
 		"signature": TorEntry{signatureHash},
 	}
 	for key, value := range expected {
-		if !reflect.DeepEqual(value[0], parsed[0].Entries[key][0].Joined()) {
-			hash := sha256.Sum256(parsed[0].Entries[key][0].Joined())
+		if !reflect.DeepEqual(value[0], parsed[0][key][0].Joined()) {
+			hash := sha256.Sum256(parsed[0][key][0].Joined())
 			if !reflect.DeepEqual(hash[:], value[0]) {
-				fmt.Printf("%s - real\n%s - expected\n", parsed[0].Entries[key][0].Joined(), value[0])
+				fmt.Printf("%s - real\n%s - expected\n", parsed[0][key][0].Joined(), value[0])
 				fmt.Printf("%x - real\n%x - expected\n", hash, value[0])
 				t.Errorf("Field mismatch at '%v'", key)
 			}
@@ -66,20 +68,18 @@ func testServerDescriptor(t *testing.T) {
 	/* Consensus parsing test */
 	desc, err := ioutil.ReadFile("../test/server-descriptor")
 	if err != nil {
-		t.Error("Unable to find open a file: %v", err)
+		t.Fatalf("Unable to find open a file: %v", err)
 	}
 	parsed, rest := ParseTorDocument(desc)
 	if len(rest) > 0 {
-		t.Error("Some fields left unparsed: '%v'", rest)
+		t.Errorf("Some fields left unparsed: '%v'", rest)
 	}
 	if len(parsed) != 1 {
 		t.Error("There is not exactly one descriptor")
 	}
 	//fmt.Printf("%v\n", parsed)
 	//for index, value := range
-	fmt.Printf("%s\n", parsed[0].Entries["reject"].Joined())
-	descr := ParseServerDescriptors(desc)
-	fmt.Printf("%v\n", descr)
+	fmt.Printf("%s\n", parsed[0]["reject"].FJoined())
 
 }
 
@@ -88,13 +88,13 @@ func testConsensus(t *testing.T) {
 	/* Consensus parsing test */
 	consensus, err := ioutil.ReadFile("../test/consensus")
 	if err != nil {
-		t.Error("Unable to find open a file: %v", err)
+		t.Fatalf("Unable to find open a file: %v", err)
 	}
 	parsed, rest := ParseTorDocument(consensus)
 	if len(rest) > 0 {
-		t.Error("Some fields left unparsed: '%v'", rest)
+		t.Errorf("Some fields left unparsed: '%v'", rest)
 	}
-	for _, value := range parsed[0].Entries["r"] {
+	for _, value := range parsed[0]["r"] {
 		fmt.Printf("%s:%s\n", value[5], value[6])
 	}
 
@@ -127,3 +127,223 @@ func testConsensus(t *testing.T) {
 	}
 	*/
 }
+
+func TestParseAnnotations(t *testing.T) {
+	data := []byte("@downloaded-at 2016-06-21 20:10:00\n" +
+		"@source \"127.0.0.1\"\n" +
+		"doc a\n" +
+		"field 1\n" +
+		"doc b\n" +
+		"field 2\n" +
+		"@downloaded-at 2016-06-21 21:10:00\n" +
+		"doc c\n" +
+		"field 3\n")
+	parsed, _ := ParseTorDocument(data)
+	if len(parsed) != 3 {
+		t.Fatalf("Expected 3 documents, got %d", len(parsed))
+	}
+	if string(parsed[0]["@source"].FJoined()) != "\"127.0.0.1\"" {
+		t.Errorf("Annotation is not attached to the first document")
+	}
+	if _, ok := parsed[1]["@downloaded-at"]; ok {
+		t.Errorf("Annotation is attached to the wrong document")
+	}
+	if string(parsed[2]["@downloaded-at"].FJoined()) != "2016-06-21 21:10:00" {
+		t.Errorf("Annotation is not attached to the last document")
+	}
+	for i, doc := range parsed {
+		if string(doc["field"].FJoined()) != fmt.Sprintf("%d", i+1) {
+			t.Errorf("Wrong field in document %d", i)
+		}
+	}
+}
+
+func TestParseRest(t *testing.T) {
+	doc := "doc a\n" +
+		"key\n" +
+		"-----BEGIN MESSAGE-----\n" +
+		"AAEC\n" +
+		"-----END MESSAGE-----\n" +
+		"signature\n" +
+		"-----BEGIN SIGNATURE-----\n" +
+		"AwQF\n" +
+		"-----END SIGNATURE-----\n"
+	parsed, rest := ParseTorDocument([]byte(doc + doc + "\n"))
+	if len(parsed) != 2 {
+		t.Fatalf("Expected 2 documents, got %d", len(parsed))
+	}
+	if len(rest) != 0 {
+		t.Errorf("Some data left unparsed: '%s'", rest)
+	}
+	for _, doc := range parsed {
+		if !reflect.DeepEqual(doc["signature"].FJoined(), []byte{3, 4, 5}) {
+			t.Errorf("Wrong signature")
+		}
+		if _, ok := doc[""]; ok {
+			t.Errorf("Empty line is parsed as a field")
+		}
+	}
+	parsed, rest = ParseTorDocument([]byte(doc + "doc b"))
+	if len(parsed) != 1 || string(rest) != "doc b" {
+		t.Errorf("Incomplete trailing line is not left in rest")
+	}
+	parsed, rest = ParseTorDocument([]byte("doc a\nkey\n-----BEGIN MESSAGE-----\nAAEC\n"))
+	if string(rest) != "key\n-----BEGIN MESSAGE-----\nAAEC\n" {
+		t.Errorf("Malformed PEM block is not left in rest: '%s'", rest)
+	}
+}
+
+func TestCheckDocument(t *testing.T) {
+	garbage := make([]byte, 4096)
+	for i := 0; i < 100; i++ {
+		rand.Read(garbage)
+		if err := CheckDocument(garbage); err != ErrNotDocument {
+			t.Fatalf("Random data is recognized as a document")
+		}
+		parsed, rest := ParseTorDocument(garbage)
+		if parsed != nil || len(rest) != len(garbage) {
+			t.Fatalf("Random data is parsed")
+		}
+	}
+	/* TLS handshake record */
+	tls := []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01, 0x00, 0x01, 0xfc, '\n'}
+	if err := CheckDocument(tls); err != ErrNotDocument {
+		t.Errorf("TLS record is recognized as a document")
+	}
+	for _, doc := range []string{
+		"rendezvous-service-descriptor abc\nversion 2\n",
+		"@downloaded-at 2016-06-21 20:10:00\nrouter a\n",
+		"signature\n",
+		"signature\r\n",
+		"\n\r\nrouter a\n",
+		"@source \u00e9t\u00e9 \u2603\nrouter a\n",
+		"router a\ncontact \u4e2d\u6587 <a@example.com>\n",
+		"router a\ncontact " + strings.Repeat("\u2603", SniffLength) + "\n",
+	} {
+		if err := CheckDocument([]byte(doc)); err != nil {
+			t.Errorf("Valid document %q is rejected", doc)
+		}
+	}
+	parsed, _ := ParseTorDocument([]byte("\n\nrouter a\ncontact \u4e2d\u6587\n"))
+	if len(parsed) != 1 || string(parsed[0]["contact"].FJoined()) != "\u4e2d\u6587" {
+		t.Errorf("Document with leading blank lines and UTF-8 is not parsed: %v", parsed)
+	}
+	for _, doc := range []string{
+		"", "no newline", "{\"json\": 1}\n", " leading space\n", "\n\n",
+		"router a\ncontact \xff\xfe\n", "router a\x00\n", "router a\x1b[0m\n",
+	} {
+		if err := CheckDocument([]byte(doc)); err != ErrNotDocument {
+			t.Errorf("Invalid document %q is accepted", doc)
+		}
+	}
+}
+
+func TestRepeatedFields(t *testing.T) {
+	data := []byte("router a\n" +
+		"or-address 10.0.0.1:9001\n" +
+		"platform Tor\n" +
+		"or-address [::1]:9001\n" +
+		"or-address 10.0.0.2:443\n" +
+		"router b\n" +
+		"or-address 10.0.0.3:9001\n")
+	parsed, rest := ParseTorDocument(data)
+	if len(rest) != 0 || len(parsed) != 2 {
+		t.Fatalf("Unable to parse documents")
+	}
+	expected := [][]byte{
+		[]byte("10.0.0.1:9001"),
+		[]byte("[::1]:9001"),
+		[]byte("10.0.0.2:443"),
+	}
+	if !reflect.DeepEqual(parsed[0].Values("or-address"), expected) {
+		t.Errorf("Wrong repeated values: %q", parsed[0].Values("or-address"))
+	}
+	if !reflect.DeepEqual(parsed[1].Values("or-address"), [][]byte{[]byte("10.0.0.3:9001")}) {
+		t.Errorf("Repeated values leak into the next document")
+	}
+	if parsed[0].Values("missing") != nil {
+		t.Errorf("Values of a missing field are not nil")
+	}
+	if ExactlyOnce(parsed[0]["or-address"]) || !ExactlyOnce(parsed[0]["platform"]) {
+		t.Errorf("Wrong number of occurrences")
+	}
+}
+
+func TestObjectType(t *testing.T) {
+	data := []byte("doc a\n" +
+		"key\n-----BEGIN RSA PUBLIC KEY-----\nAAEC\n-----END RSA PUBLIC KEY-----\n" +
+		"plain value\n" +
+		"signature\n-----BEGIN SIGNATURE-----\nAAEC\n-----END SIGNATURE-----\n")
+	parsed, rest := ParseTorDocumentFull(data)
+	if len(rest) != 0 || len(parsed) != 1 {
+		t.Fatalf("Unable to parse document")
+	}
+	for field, expected := range map[string]string{
+		"key":       "RSA PUBLIC KEY",
+		"plain":     "",
+		"signature": "SIGNATURE",
+		"missing":   "",
+	} {
+		if objectType := parsed[0].ObjectType(field); objectType != expected {
+			t.Errorf("Wrong object type of %s: %q", field, objectType)
+		}
+	}
+	if !reflect.DeepEqual(parsed[0].Fields["signature"].FJoined(), []byte{0, 1, 2}) {
+		t.Errorf("Object content is not preserved")
+	}
+}
+
+func TestParseMixedDocuments(t *testing.T) {
+	data := "router a 10.0.0.1 9001 0 80\n" +
+		"platform Tor\n" +
+		"rendezvous-service-descriptor b\n" +
+		"version 2\n" +
+		"extra-info c\n" +
+		"published 2016-06-21 20:00:00\n" +
+		"rendezvous-service-descriptor d\n" +
+		"version 2\n"
+	parsed, rest := ParseMixedDocuments([]byte(data + "router e"))
+	if len(parsed) != 4 {
+		t.Fatalf("Expected 4 documents, got %d", len(parsed))
+	}
+	for i, keyword := range []string{"router", "rendezvous-service-descriptor", "extra-info", "rendezvous-service-descriptor"} {
+		if _, ok := parsed[i][keyword]; !ok || len(parsed[i]) != 2 {
+			t.Errorf("Document %d is not %s: %v", i, keyword, parsed[i])
+		}
+	}
+	if string(rest) != "router e" {
+		t.Errorf("Incomplete trailing line is not left in rest: '%s'", rest)
+	}
+	if parsed, _ := ParseTorDocument([]byte(data)); len(parsed) != 1 {
+		t.Errorf("ParseTorDocument splits documents by other keywords")
+	}
+}
+
+func TestRaw(t *testing.T) {
+	first := "doc a\nkey\n-----BEGIN MESSAGE-----\nAAEC\n-----END MESSAGE-----\n"
+	second := "doc b\nkey c\n"
+	parsed, _ := ParseTorDocumentFull([]byte(first + "\n@source x\n" + second + "\ndoc"))
+	if len(parsed) != 2 {
+		t.Fatalf("Expected 2 documents, got %d", len(parsed))
+	}
+	if string(parsed[0].Raw) != first {
+		t.Errorf("Wrong raw bytes of the first document: '%s'", parsed[0].Raw)
+	}
+	if string(parsed[1].Raw) != second {
+		t.Errorf("Wrong raw bytes of the second document: '%s'", parsed[1].Raw)
+	}
+	if len(parsed[1].Fields) != 3 {
+		t.Errorf("Raw bytes are stored among fields: %v", parsed[1].Fields)
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	doc := "@source x\ndoc a\nkey\n-----BEGIN MESSAGE-----\nAAEC\n-----END MESSAGE-----\nextra b\nextra c\n"
+	parsed, _ := ParseTorDocument([]byte(doc))
+	if len(parsed) != 1 {
+		t.Fatalf("Expected 1 document, got %d", len(parsed))
+	}
+	if keywords := parsed[0].Keywords(); !reflect.DeepEqual(keywords, []string{"doc", "extra", "key"}) {
+		t.Errorf("Wrong keywords: %v", keywords)
+	}
+}
@@ -0,0 +1,134 @@
+// v3.go - cryptographic constructions of v3 onion services
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+)
+
+var (
+	CredentialPrefix    = []byte("credential")
+	SubcredentialPrefix = []byte("subcredential")
+	HSDirIndexPrefix    = []byte("store-at-idx")
+	RelayIndexPrefix    = []byte("node-idx")
+	BlindString         = []byte("Derive temporary signing key\x00")
+	KeyBlindPrefix      = []byte("key-blind")
+)
+
+const (
+	// V3TimePeriodLength is the default length of a time period in minutes.
+	V3TimePeriodLength = 1440
+	// V3TimePeriodRotationOffset is the offset (in minutes) of time period
+	// start from the beginning of the day, so periods begin at 12:00 UTC.
+	V3TimePeriodRotationOffset = 12 * 60
+)
+
+// edBaseString is the string representation of the edwards25519 base point
+// used in the key blinding hash.
+const edBaseString = "(15112221349535400772501151409588531511454012693041857206046113283949847762202, " +
+	"46316835694926478169428394003475163141307993866256225615783033603165251855960)"
+
+// Credential calculates credential of the service with identity key pub:
+// H("credential" | public-identity-key).
+func Credential(pub ed25519.PublicKey) []byte {
+	h := sha3.New256()
+	h.Write(CredentialPrefix)
+	h.Write([]byte(pub))
+	return h.Sum(nil)
+}
+
+// Subcredential calculates subcredential from credential cred and
+// blinded public key blinded: H("subcredential" | credential | blinded-key).
+func Subcredential(cred, blinded []byte) []byte {
+	h := sha3.New256()
+	h.Write(SubcredentialPrefix)
+	h.Write(cred)
+	h.Write(blinded)
+	return h.Sum(nil)
+}
+
+func uint64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// V3HSDirIndex calculates position of replica replica of a descriptor with
+// blinded key blinded on the hash ring for time period periodNum of length
+// periodLen (in minutes): H("store-at-idx" | blinded-key | INT_8(replicanum) |
+// INT_8(period_length) | INT_8(period_num)).
+func V3HSDirIndex(blinded []byte, replica, periodLen, periodNum uint64) []byte {
+	h := sha3.New256()
+	h.Write(HSDirIndexPrefix)
+	h.Write(blinded)
+	h.Write(uint64Bytes(replica))
+	h.Write(uint64Bytes(periodLen))
+	h.Write(uint64Bytes(periodNum))
+	return h.Sum(nil)
+}
+
+// V3RelayIndex calculates position of a relay with Ed25519 identity key
+// identity on the hash ring for shared random value srv and time period
+// periodNum of length periodLen (in minutes): H("node-idx" | node_identity |
+// shared_random_value | INT_8(period_num) | INT_8(period_length)).
+func V3RelayIndex(identity, srv []byte, periodNum, periodLen uint64) []byte {
+	h := sha3.New256()
+	h.Write(RelayIndexPrefix)
+	h.Write(identity)
+	h.Write(srv)
+	h.Write(uint64Bytes(periodNum))
+	h.Write(uint64Bytes(periodLen))
+	return h.Sum(nil)
+}
+
+// V3TimePeriod returns number of the time period of default length that
+// contains now.
+func V3TimePeriod(now time.Time) uint64 {
+	minutes := uint64(now.Unix() / 60)
+	return (minutes - V3TimePeriodRotationOffset) / V3TimePeriodLength
+}
+
+// BlindPublicKey derives the blinded public key of the service with
+// identity key pub for time period periodNum of length periodLen (in
+// minutes): h*A, where h = H(BLIND_STRING | A | B | "key-blind" |
+// INT_8(period_num) | INT_8(period_length)) clamped as an Ed25519 scalar.
+func BlindPublicKey(pub ed25519.PublicKey, periodNum, periodLen uint64) (ed25519.PublicKey, error) {
+	a, err := edDecodePoint(pub)
+	if err != nil {
+		return nil, err
+	}
+	h := sha3.New256()
+	h.Write(BlindString)
+	h.Write([]byte(pub))
+	h.Write([]byte(edBaseString))
+	h.Write(KeyBlindPrefix)
+	h.Write(uint64Bytes(periodNum))
+	h.Write(uint64Bytes(periodLen))
+	param := h.Sum(nil)
+	param[0] &= 248
+	param[31] &= 63
+	param[31] |= 64
+	return ed25519.PublicKey(a.scalarMult(edScalar(param)).bytes()), nil
+}
+
+// V3CacheKey returns a key under which a client may cache the descriptor
+// of the service with identity key pub at time now: the base64-encoded
+// blinded key for the current time period. Empty string is returned if
+// pub is not a valid public key.
+func V3CacheKey(pub ed25519.PublicKey, now time.Time) string {
+	blinded, err := BlindPublicKey(pub, V3TimePeriod(now), V3TimePeriodLength)
+	if err != nil {
+		return ""
+	}
+	return base64.RawStdEncoding.EncodeToString(blinded)
+}
@@ -0,0 +1,115 @@
+package onionutil
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func testBytes(from, to int) []byte {
+	var b []byte
+	for i := from; i < to; i++ {
+		b = append(b, byte(i))
+	}
+	return b
+}
+
+// Keys of test_blinding_basics in tor's src/test/test_hs_common.c.
+const (
+	torTestPublicKey  = "833990b085c1a688c1d4c8b1f6b56afaf5a2eca674449e1d704f83765ccb7bc6"
+	torTestBlindedKey = "3a50bf210e8f9ee955ae0014f7a6917fb65ebf098a86305abb508d1a7291b6d5"
+)
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestSubcredential(t *testing.T) {
+	// Vector from test_blinding_basics in tor's src/test/test_hs_common.c.
+	pub := ed25519.PublicKey(mustDecodeHex(torTestPublicKey))
+	subcred := Subcredential(Credential(pub), mustDecodeHex(torTestBlindedKey))
+	if hex.EncodeToString(subcred) != "635d55907816e8d76398a675a50b1c2f3e36b42a5ca77ba3a0441285161ae07d" {
+		t.Fatalf("wrong subcredential: %x", subcred)
+	}
+}
+
+// TestV3HSDirIndex uses regression vectors: they were produced by this
+// implementation, not taken from tor or rend-spec-v3, and only guard
+// against accidental changes.
+func TestV3HSDirIndex(t *testing.T) {
+	idx := V3HSDirIndex(testBytes(32, 64), 1, 1440, 17000)
+	if hex.EncodeToString(idx) != "f872d82f6d84f681f24374e60cdfd96161eaabc0b98529b0c9c1d2dae9ee83d6" {
+		t.Fatalf("wrong hsdir index: %x", idx)
+	}
+	idx = V3RelayIndex(testBytes(0, 32), testBytes(64, 96), 17000, 1440)
+	if hex.EncodeToString(idx) != "eb470dd7ab1c5e1da9471ece6d69c7ba7491f74ad4f97f5299d3e06d08590702" {
+		t.Fatalf("wrong relay index: %x", idx)
+	}
+}
+
+func TestBlindPublicKey(t *testing.T) {
+	seed := testBytes(0, 32)
+	pub := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	a := edScalar(ExpandEd25519PrivateKey(ed25519.NewKeyFromSeed(seed))[:32])
+	if got := edBase.scalarMult(a).bytes(); !bytes.Equal(got, pub) {
+		t.Fatalf("wrong public key: %x", got)
+	}
+
+	// Vector from test_blinding_basics in tor's src/test/test_hs_common.c.
+	blinded, err := BlindPublicKey(mustDecodeHex(torTestPublicKey), 1234, 1440)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(blinded) != torTestBlindedKey {
+		t.Fatalf("wrong blinded key: %x", blinded)
+	}
+	other, _ := BlindPublicKey(mustDecodeHex(torTestPublicKey), 1235, 1440)
+	if bytes.Equal(blinded, other) {
+		t.Fatal("blinded key doesn't depend on time period")
+	}
+
+	invalid := make([]byte, 32)
+	invalid[0] = 2
+	if _, err := BlindPublicKey(invalid, 17000, V3TimePeriodLength); err == nil {
+		t.Fatal("invalid key is blinded")
+	}
+}
+
+func TestV3TimePeriod(t *testing.T) {
+	for _, c := range []struct {
+		now    time.Time
+		period uint64
+	}{
+		// Example of [TIME-PERIODS] in rend-spec-v3.
+		{time.Date(2016, 4, 13, 11, 15, 1, 0, time.UTC), 16903},
+		// Time period of test_blinding_basics in tor's
+		// src/test/test_hs_common.c.
+		{time.Date(1973, 5, 20, 1, 50, 33, 0, time.UTC), 1234},
+	} {
+		if period := V3TimePeriod(c.now); period != c.period {
+			t.Errorf("%v: time period %d instead of %d", c.now, period, c.period)
+		}
+	}
+}
+
+func TestV3CacheKey(t *testing.T) {
+	pub := ed25519.NewKeyFromSeed(testBytes(0, 32)).Public().(ed25519.PublicKey)
+	start := time.Date(2016, 6, 21, 12, 0, 0, 0, time.UTC)
+	if V3TimePeriod(start) != V3TimePeriod(start.Add(-time.Second))+1 {
+		t.Fatal("time period doesn't start at 12:00 UTC")
+	}
+	key := V3CacheKey(pub, start)
+	if key == "" || key != V3CacheKey(pub, start.Add(23*time.Hour)) {
+		t.Fatal("cache key is not stable within a time period")
+	}
+	if key == V3CacheKey(pub, start.Add(24*time.Hour)) {
+		t.Fatal("cache key doesn't change with time period")
+	}
+}
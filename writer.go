@@ -0,0 +1,44 @@
+// writer.go - streaming encoding of onion service descriptors.
+//
+// To the extent possible under law, Ivan Markin waived all copyright
+// and related or neighboring rights to this module of onionutil, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package onionutil
+
+import (
+	"crypto"
+	"errors"
+	"io"
+)
+
+// DescriptorWriter writes a stream of concatenated descriptors that
+// can be read back by ParseOnionDescriptors.
+type DescriptorWriter struct {
+	w io.Writer
+}
+
+// NewDescriptorWriter returns DescriptorWriter writing to w.
+func NewDescriptorWriter(w io.Writer) *DescriptorWriter {
+	return &DescriptorWriter{w: w}
+}
+
+// Write signs desc with signer and appends it to the stream. If signer
+// is nil desc is written as is, so it must be signed already.
+func (dw *DescriptorWriter) Write(desc *OnionDescriptor, signer crypto.Signer) error {
+	if signer != nil {
+		if err := desc.Sign(signer); err != nil {
+			return err
+		}
+	}
+	if len(desc.Signature) == 0 {
+		return errors.New("descriptor is not signed")
+	}
+	body, err := desc.Body()
+	if err != nil {
+		return err
+	}
+	_, err = dw.w.Write(body)
+	return err
+}
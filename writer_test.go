@@ -0,0 +1,45 @@
+package onionutil
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestDescriptorWriter(t *testing.T) {
+	sk := testPrivateKey(t)
+	now := time.Unix(1466539200, 0)
+	descs, err := BuildReplicaDescriptors(&sk.PublicKey, testIntroPoints(t, 3), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := NewDescriptorWriter(&buf)
+	for _, desc := range descs {
+		if err := w.Write(desc, sk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Write(&OnionDescriptor{}, nil); err == nil {
+		t.Fatal("unsigned descriptor is written")
+	}
+
+	parsed, rest, err := new(Parser).ParseOnionDescriptors(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 0 {
+		t.Errorf("unparsed data left: %q", rest)
+	}
+	if len(parsed) != len(descs) {
+		t.Fatalf("expected %d descriptors, got %d", len(descs), len(parsed))
+	}
+	for i := range parsed {
+		if parsed[i].DescID != descs[i].DescID {
+			t.Errorf("descriptor %d: id mismatch", i)
+		}
+		if err := parsed[i].VerifySignature(); err != nil {
+			t.Errorf("descriptor %d: %v", i, err)
+		}
+	}
+}